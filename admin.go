@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	ADMIN_SYNC   = "sync"
+	ADMIN_PLAN   = "plan"
+	ADMIN_PAUSE  = "pause"
+	ADMIN_RESUME = "resume"
+	ADMIN_VERIFY = "verify"
+)
+
+// adminRequest is a request made through the admin API, which is handled by
+// the synchronization loop so that it never runs concurrently with a
+// synchronization
+type adminRequest struct {
+	kind   string
+	verify bool
+	reply  chan *AdminResult
+}
+
+// PlannedChange is a change to a rule, as reported by the admin API
+type PlannedChange struct {
+	Action string          `json:"action"`
+	Switch string          `json:"switch"`
+	Port   string          `json:"port,omitempty"`
+	Vlan   string          `json:"vlan,omitempty"`
+	FlowId string          `json:"flowId,omitempty"`
+	Reason string          `json:"reason,omitempty"`
+	Source string          `json:"source,omitempty"`
+	Flow   json.RawMessage `json:"flow,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// AdminResult is the response to an admin API request
+type AdminResult struct {
+	Paused  bool            `json:"paused"`
+	Verify  bool            `json:"verify"`
+	Error   string          `json:"error,omitempty"`
+	Changes []PlannedChange `json:"changes,omitempty"`
+}
+
+// observing returns true if changes should be determined but not made
+func (app *Application) observing() bool {
+	return app.Verify || app.paused || app.planning
+}
+
+// adminResult reports the outcome of the most recent synchronization
+func (app *Application) adminResult(err error) *AdminResult {
+	result := &AdminResult{
+		Paused:  app.paused,
+		Verify:  app.Verify,
+		Changes: []PlannedChange{},
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	for _, change := range app.changes {
+		planned := PlannedChange{
+			Action: change.Action,
+			Switch: change.Switch,
+			Port:   change.Port,
+			Vlan:   change.Vlan,
+			FlowId: change.FlowId,
+			Reason: change.Reason,
+			Source: change.Source,
+		}
+		var flow json.RawMessage
+		if json.Unmarshal(change.Flow, &flow) == nil {
+			planned.Flow = flow
+		}
+		if change.Err != nil {
+			planned.Error = change.Err.Error()
+		}
+		result.Changes = append(result.Changes, planned)
+	}
+	return result
+}
+
+/*
+ * wait waits for the next synchronization, which is either when the interval
+ * elapses, an immediate synchronization is triggered or one is requested
+ * through the admin API. Other admin requests are handled while waiting. A
+ * request for a synchronization is returned so that it can be replied to once
+ * the synchronization is complete.
+ */
+func (app *Application) wait() *adminRequest {
+	timer := time.After(app.Interval)
+	for {
+		select {
+		case <-timer:
+			return nil
+		case reason := <-app.triggers:
+			log.Infof("Immediate synchronization : %s", reason)
+			return nil
+		case request := <-app.requests:
+			switch request.kind {
+			case ADMIN_SYNC:
+				log.Info("Immediate synchronization : requested by admin")
+				return request
+			case ADMIN_PLAN:
+				// When planning synchronization has no side effects, e.g. traffic
+				// statistics are not sampled and the snapshot is not saved
+				app.planning = true
+				err := app.Synchronize()
+				app.planning = false
+				request.reply <- app.adminResult(err)
+				continue
+			case ADMIN_PAUSE:
+				log.Warn("Paused by admin, changes will not be made until resumed")
+				app.paused = true
+			case ADMIN_RESUME:
+				log.Warn("Resumed by admin")
+				app.paused = false
+			case ADMIN_VERIFY:
+				log.Warnf("Verify mode set to %t by admin", request.verify)
+				app.Verify = request.verify
+				if app.defaults != nil {
+					app.defaults.Verify = request.verify
+				}
+			}
+			app.updateStatus(func(status *Status) {
+				status.Paused = app.paused
+				status.Verify = app.Verify
+			})
+			request.reply <- &AdminResult{Paused: app.paused, Verify: app.Verify}
+		}
+	}
+}
+
+// authorized checks the bearer token of an admin API request
+func (app *Application) authorized(r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(app.AdminToken)) == 1
+}
+
+// adminHandler returns a handler that passes a request of the given kind to
+// the synchronization loop and replies with the result
+func (app *Application) adminHandler(kind, method string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !app.authorized(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != method {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		request := &adminRequest{
+			kind:  kind,
+			reply: make(chan *AdminResult, 1),
+		}
+		if kind == ADMIN_VERIFY {
+			var body struct {
+				Verify *bool `json:"verify"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Verify == nil {
+				http.Error(w, "expected {\"verify\": true|false}", http.StatusBadRequest)
+				return
+			}
+			request.verify = *body.Verify
+		}
+		log.Infof("Admin %s requested by %s", kind, r.RemoteAddr)
+		app.requests <- request
+		result := <-request.reply
+
+		w.Header().Set("Content-Type", "application/json")
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "    ")
+		encoder.Encode(result)
+	}
+}
+
+// serveAdmin serves the admin API, with which operators control synchronization
+func (app *Application) serveAdmin() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sync", app.adminHandler(ADMIN_SYNC, http.MethodPost))
+	mux.HandleFunc("/plan", app.adminHandler(ADMIN_PLAN, http.MethodGet))
+	mux.HandleFunc("/pause", app.adminHandler(ADMIN_PAUSE, http.MethodPost))
+	mux.HandleFunc("/resume", app.adminHandler(ADMIN_RESUME, http.MethodPost))
+	mux.HandleFunc("/verify", app.adminHandler(ADMIN_VERIFY, http.MethodPut))
+	mux.HandleFunc("/overrides", app.handleOverrides)
+	log.Infof("Serving admin API on %s", app.AdminListen)
+	if err := http.ListenAndServe(app.AdminListen, mux); err != nil {
+		log.Fatalf("Unable to serve admin API on '%s' : %s", app.AdminListen, err)
+	}
+}
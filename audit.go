@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AUDIT_CREATE = "create"
+	AUDIT_DELETE = "delete"
+	AUDIT_STDOUT = "-"
+)
+
+// AuditResponse captures the response ONOS returned for an audited change
+type AuditResponse struct {
+	Status int    `json:"status,omitempty"`
+	Body   string `json:"body,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// AuditRecord is a single entry in the audit journal, one per flow change
+type AuditRecord struct {
+	Timestamp time.Time       `json:"timestamp"`
+	Switch    string          `json:"switch"`
+	Vlan      string          `json:"vlan"`
+	FlowId    string          `json:"flowId,omitempty"`
+	Action    string          `json:"action"`
+	Flow      json.RawMessage `json:"flow,omitempty"`
+	Reason    string          `json:"reason"`
+	Device    string          `json:"device,omitempty"`
+	Response  AuditResponse   `json:"response"`
+}
+
+// AuditLog is an append only journal of JSON lines, rotated when it grows
+// beyond a maximum size
+type AuditLog struct {
+	sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	out        io.Writer
+	file       *os.File
+	size       int64
+}
+
+// NewAuditLog opens the audit journal at the given path. The path "-" writes
+// the journal to stdout, in which case rotation does not apply.
+func NewAuditLog(path string, maxSize int64, maxBackups int) (*AuditLog, error) {
+	audit := &AuditLog{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+	if path == AUDIT_STDOUT {
+		audit.out = os.Stdout
+		return audit, nil
+	}
+	if err := audit.open(); err != nil {
+		return nil, err
+	}
+	return audit, nil
+}
+
+func (audit *AuditLog) open() error {
+	file, err := os.OpenFile(audit.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	audit.file = file
+	audit.out = file
+	audit.size = info.Size()
+	return nil
+}
+
+// rotate shifts the existing journal files up by one, i.e. audit.log becomes
+// audit.log.1, dropping any that fall beyond the maximum number of backups
+func (audit *AuditLog) rotate() error {
+	audit.file.Close()
+	for i := audit.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", audit.path, i), fmt.Sprintf("%s.%d", audit.path, i+1))
+	}
+	if audit.maxBackups > 0 {
+		os.Rename(audit.path, audit.path+".1")
+	} else {
+		os.Remove(audit.path)
+	}
+	return audit.open()
+}
+
+// Record appends a record to the journal
+func (audit *AuditLog) Record(rec *AuditRecord) {
+	if audit == nil {
+		return
+	}
+	if rec.Timestamp.IsZero() {
+		rec.Timestamp = time.Now().UTC()
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.Errorf("Unable to encode audit record for VLAN %s : %s", rec.Vlan, err)
+		return
+	}
+	data = append(data, '\n')
+
+	audit.Lock()
+	defer audit.Unlock()
+	if audit.file != nil && audit.maxSize > 0 && audit.size+int64(len(data)) > audit.maxSize {
+		if err := audit.rotate(); err != nil {
+			log.Errorf("Unable to rotate audit log '%s' : %s", audit.path, err)
+			return
+		}
+	}
+	n, err := audit.out.Write(data)
+	audit.size += int64(n)
+	if err != nil {
+		log.Errorf("Unable to write audit record to '%s' : %s", audit.path, err)
+	}
+}
+
+// auditResponse builds the response portion of an audit record from the
+// result of an HTTP request to ONOS. The response body is consumed.
+func auditResponse(resp *http.Response, err error) AuditResponse {
+	if err != nil {
+		return AuditResponse{Error: err.Error()}
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	return AuditResponse{
+		Status: resp.StatusCode,
+		Body:   strings.TrimSpace(string(body)),
+	}
+}
+
+// auditFiles returns the journal and its rotated backups, oldest first
+func auditFiles(path string) []string {
+	matches, _ := filepath.Glob(path + ".*")
+	backups := make(map[int]string)
+	idx := []int{}
+	for _, match := range matches {
+		if n, err := strconv.Atoi(strings.TrimPrefix(match, path+".")); err == nil {
+			backups[n] = match
+			idx = append(idx, n)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(idx)))
+	files := []string{}
+	for _, n := range idx {
+		files = append(files, backups[n])
+	}
+	return append(files, path)
+}
+
+// parseAuditTime accepts either an RFC3339 timestamp or a duration, which is
+// interpreted as relative to now, i.e. "1h" means one hour ago
+func parseAuditTime(value string) (time.Time, error) {
+	if d, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// auditCommand implements the "letmein audit" command, which queries the
+// audit journal by VLAN and time range
+func auditCommand(app *Application, args []string) int {
+	var since, until, vlan string
+
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	flags.StringVar(&vlan, "vlan", "", "only show records for this VLAN")
+	flags.StringVar(&since, "since", "", "only show records at or after this time (RFC3339 or duration)")
+	flags.StringVar(&until, "until", "", "only show records before this time (RFC3339 or duration)")
+	flags.StringVar(&app.AuditLog, "file", app.AuditLog, "audit journal to query")
+	flags.Parse(args)
+
+	if app.AuditLog == "" || app.AuditLog == AUDIT_STDOUT {
+		fmt.Fprintln(os.Stderr, "No audit journal file configured, set AUDIT_LOG or use -file")
+		return 2
+	}
+
+	var from, to time.Time
+	var err error
+	if since != "" {
+		if from, err = parseAuditTime(since); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid value for -since '%s' : %s\n", since, err)
+			return 2
+		}
+	}
+	if until != "" {
+		if to, err = parseAuditTime(until); err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid value for -until '%s' : %s\n", until, err)
+			return 2
+		}
+	}
+
+	for _, name := range auditFiles(app.AuditLog) {
+		file, err := os.Open(name)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				fmt.Fprintf(os.Stderr, "Unable to open audit journal '%s' : %s\n", name, err)
+			}
+			continue
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var rec AuditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				continue
+			}
+			if vlan != "" && rec.Vlan != vlan {
+				continue
+			}
+			if !from.IsZero() && rec.Timestamp.Before(from) {
+				continue
+			}
+			if !to.IsZero() && !rec.Timestamp.Before(to) {
+				continue
+			}
+			fmt.Println(scanner.Text())
+		}
+		file.Close()
+	}
+	return 0
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	REDACTED = "REDACTED"
+)
+
+// Interaction is an HTTP request made during a synchronization and the
+// response to it
+type Interaction struct {
+	Method  string            `json:"method"`
+	Url     string            `json:"url"`
+	Request string            `json:"request,omitempty"`
+	Status  int               `json:"status,omitempty"`
+	Header  map[string]string `json:"header,omitempty"`
+	Body    string            `json:"body,omitempty"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// key identifies the request, which includes its body as concurrent requests
+// to the same URL, e.g. to create flows, are made in no particular order
+func (interaction *Interaction) key() string {
+	return interaction.Method + " " + interaction.Url + " " + interaction.Request
+}
+
+/*
+ * Cassette is a recording of a synchronization: the configuration, the
+ * contents of the local files it read, every HTTP request made along with
+ * the response and the resulting plan. Replaying a cassette repeats the
+ * synchronization without any network access, so that issues seen in the
+ * field can be debugged locally. Credentials are redacted.
+ */
+type Cassette struct {
+	Recorded     time.Time         `json:"recorded"`
+	Config       json.RawMessage   `json:"config"`
+	Snapshot     *Snapshot         `json:"snapshot,omitempty"`
+	Files        map[string]string `json:"files"`
+	Interactions []Interaction     `json:"interactions"`
+	Error        string            `json:"error,omitempty"`
+	Plan         []PlannedChange   `json:"plan"`
+}
+
+// readFile reads the local files used during a synchronization, so that they
+// can be recorded and replayed
+var readFile = ioutil.ReadFile
+
+// redactUrl replaces the password, if any, of a URL
+func redactUrl(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.User == nil {
+		return value
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), REDACTED)
+	}
+	return u.String()
+}
+
+// recorder is an HTTP transport that records the requests made through it,
+// along with the local files that are read
+type recorder struct {
+	lock         sync.Mutex
+	transport    http.RoundTripper
+	interactions []Interaction
+	files        map[string]string
+}
+
+func (rec *recorder) readFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		rec.lock.Lock()
+		rec.files[path] = string(data)
+		rec.lock.Unlock()
+	}
+	return data, err
+}
+
+func (rec *recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	interaction := Interaction{
+		Method: req.Method,
+		Url:    redactUrl(req.URL.String()),
+	}
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		interaction.Request = string(body)
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	resp, err := rec.transport.RoundTrip(req)
+	if err != nil {
+		interaction.Error = err.Error()
+	} else {
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		interaction.Status = resp.StatusCode
+		interaction.Body = string(body)
+		interaction.Header = make(map[string]string)
+		for _, name := range []string{"Content-Type", "Location"} {
+			if value := resp.Header.Get(name); value != "" {
+				interaction.Header[name] = redactUrl(value)
+			}
+		}
+	}
+
+	rec.lock.Lock()
+	rec.interactions = append(rec.interactions, interaction)
+	rec.lock.Unlock()
+	return resp, err
+}
+
+// reset discards the recorded interactions and files, returning them
+func (rec *recorder) reset() ([]Interaction, map[string]string) {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	interactions, files := rec.interactions, rec.files
+	rec.interactions, rec.files = nil, make(map[string]string)
+	return interactions, files
+}
+
+/*
+ * player is an HTTP transport that responds to requests with the responses
+ * recorded in a cassette. Responses to the same request are returned in the
+ * order they were recorded, the last being repeated should the request be
+ * made more often than when recorded, e.g. when polling.
+ */
+type player struct {
+	lock      sync.Mutex
+	responses map[string][]Interaction
+}
+
+func newPlayer(interactions []Interaction) *player {
+	responses := make(map[string][]Interaction)
+	for _, interaction := range interactions {
+		responses[interaction.key()] = append(responses[interaction.key()], interaction)
+	}
+	return &player{responses: responses}
+}
+
+func (play *player) RoundTrip(req *http.Request) (*http.Response, error) {
+	request := Interaction{
+		Method: req.Method,
+		Url:    redactUrl(req.URL.String()),
+	}
+	if req.Body != nil {
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		request.Request = string(body)
+	}
+	key := request.key()
+
+	play.lock.Lock()
+	recorded := play.responses[key]
+	if len(recorded) == 0 {
+		play.lock.Unlock()
+		return nil, fmt.Errorf("no recorded response to %s %s", request.Method, request.Url)
+	}
+	interaction := recorded[0]
+	if len(recorded) > 1 {
+		play.responses[key] = recorded[1:]
+	}
+	play.lock.Unlock()
+
+	if interaction.Error != "" {
+		return nil, fmt.Errorf("%s", interaction.Error)
+	}
+	header := make(http.Header)
+	for name, value := range interaction.Header {
+		header.Set(name, value)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", interaction.Status, http.StatusText(interaction.Status)),
+		StatusCode:    interaction.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(interaction.Body)),
+		ContentLength: int64(len(interaction.Body)),
+		Request:       req,
+	}, nil
+}
+
+// useTransport sends the HTTP requests of synchronizations through the given
+// transport. Those made in the background, i.e. by the switch watcher and for
+// webhook notifications, use clients of their own so are not recorded.
+func (app *Application) useTransport(transport http.RoundTripper) {
+	app.client.Transport = transport
+}
+
+// redactedConfig returns the configuration with credentials redacted
+func (app *Application) redactedConfig() (json.RawMessage, error) {
+	data, err := json.Marshal(app)
+	if err != nil {
+		return nil, err
+	}
+	config := make(map[string]interface{})
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	config["OnosConnectUrl"] = redactUrl(app.OnosConnectUrl)
+	config["SadisUrl"] = redactUrl(app.SadisUrl)
+	if app.AdminToken != "" {
+		config["AdminToken"] = REDACTED
+	}
+	if version := app.currentStatus().OnosVersion; version != "" {
+		config["OnosVersion"] = version
+	}
+	config["WebhookUrls"] = []string{}
+	sources := []string{}
+	for _, spec := range app.DesiredSources {
+		sources = append(sources, redactUrl(spec))
+	}
+	config["DesiredSources"] = sources
+	return json.Marshal(config)
+}
+
+// recordSynchronize synchronizes and, if recording, saves the interactions
+// with ONOS and the resulting plan to the record file
+func (app *Application) recordSynchronize() error {
+	if app.recorder == nil {
+		return app.Synchronize()
+	}
+	app.recorder.reset()
+	snapshot := app.snapshot
+	err := app.Synchronize()
+
+	cassette := Cassette{
+		Recorded: time.Now().UTC(),
+		Snapshot: snapshot,
+		Plan:     app.adminResult(err).Changes,
+	}
+	cassette.Interactions, cassette.Files = app.recorder.reset()
+	if err != nil {
+		cassette.Error = err.Error()
+	}
+	cassette.Config, _ = app.redactedConfig()
+	if err := saveCassette(app.RecordFile, &cassette); err != nil {
+		log.Errorf("Unable to save recording to '%s' : %s", app.RecordFile, err)
+	}
+	return err
+}
+
+// saveCassette writes a cassette to a file
+func saveCassette(path string, cassette *Cassette) error {
+	data, err := json.MarshalIndent(cassette, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// planKeys returns the changes of a plan in a canonical order, so that plans
+// can be compared
+func planKeys(plan []PlannedChange) []string {
+	keys := make([]string, 0, len(plan))
+	for _, change := range plan {
+		data, _ := json.Marshal(change)
+		keys = append(keys, string(data))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+ * replayCommand implements the "letmein replay" command, which repeats the
+ * synchronization recorded in a cassette, using the recorded configuration
+ * and responding to requests with the recorded responses, and reports
+ * whether the same plan results.
+ */
+func replayCommand(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: letmein replay <cassette>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	data, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read cassette '%s' : %s\n", flags.Arg(0), err)
+		return 1
+	}
+	var cassette Cassette
+	if err := json.Unmarshal(data, &cassette); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to parse cassette '%s' : %s\n", flags.Arg(0), err)
+		return 1
+	}
+
+	app := newApplication()
+	if err := json.Unmarshal(cassette.Config, app); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to parse configuration of cassette '%s' : %s\n", flags.Arg(0), err)
+		return 1
+	}
+
+	// Local files are read from the cassette, as they were when recorded
+	readFile = func(path string) ([]byte, error) {
+		if contents, ok := cassette.Files[path]; ok {
+			return []byte(contents), nil
+		}
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+
+	// Nothing but the synchronization itself is repeated, the state file is
+	// only cleared once the configuration that may require it is validated
+	app.AuditLog, app.RecordFile, app.StatusListen, app.AdminListen = "", "", "", ""
+	app.WebhookUrls = nil
+	app.WatchInterval = 0
+	app.useTransport(newPlayer(cassette.Interactions))
+	if err := app.configure(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	app.StateFile = ""
+	app.snapshot = cassette.Snapshot
+	if app.snapshot != nil {
+		app.objectives = app.snapshot.Objectives
+	}
+
+	log.Infof("Replaying synchronization recorded %s", cassette.Recorded)
+	err = app.Synchronize()
+	result := app.adminResult(err)
+
+	tabs := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+	fmt.Fprintln(tabs, "ACTION\tVLAN\tPORT\tFLOW\tREASON")
+	for _, change := range result.Changes {
+		fmt.Fprintf(tabs, "%s\t%s\t%s\t%s\t%s\n", change.Action, change.Vlan, change.Port, change.FlowId, change.Reason)
+	}
+	tabs.Flush()
+	if err != nil {
+		fmt.Printf("Synchronization failed : %s\n", err)
+	}
+
+	same := result.Error == cassette.Error
+	recorded, replayed := planKeys(cassette.Plan), planKeys(result.Changes)
+	if len(recorded) != len(replayed) {
+		same = false
+	}
+	for i := 0; same && i < len(recorded); i++ {
+		same = recorded[i] == replayed[i]
+	}
+	if !same {
+		fmt.Printf("Replay produced a different plan from the %d changes recorded", len(cassette.Plan))
+		if cassette.Error != "" {
+			fmt.Printf(" (recorded error : %s)", cassette.Error)
+		}
+		fmt.Println()
+		return 1
+	}
+	fmt.Printf("Replay produced the recorded plan of %d changes\n", len(cassette.Plan))
+	return 0
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Jeffail/gabs"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	SYSTEM_URL = "%s/onos/v1/system"
+
+	VERSION_DETECT = ":detect"
+)
+
+// Device is the subset of an ONOS device used by letmein
+type Device struct {
+	Id         string
+	Hw         string
+	Driver     string
+	Available  bool
+	LastUpdate string
+}
+
+// Port is the subset of an ONOS port used by letmein
+type Port struct {
+	Number      string
+	Enabled     bool
+	Local       bool
+	Annotations map[string]string
+}
+
+/*
+ * Codec decodes the JSON of the ONOS REST API, the shape of which differs
+ * between ONOS releases, e.g. whether port numbers are strings or numbers and
+ * how the local port is named. Values are never asserted to be of a particular
+ * type, so an unexpected shape results in an empty value rather than a panic.
+ */
+type Codec interface {
+	Name() string
+	Device(device *gabs.Container) Device
+	Port(port *gabs.Container) Port
+	FlowId(flow *gabs.Container) string
+
+	// FlowMatch returns the VLAN and in port matched by a flow, if any
+	FlowMatch(flow *gabs.Container) (string, string)
+
+	// FlowItem returns a criterion or instruction of a flow with its port,
+	// if any, as configured, so that the flows read from ONOS compare equal
+	// to the rules rendered from templates
+	FlowItem(item *gabs.Container) interface{}
+}
+
+// jsonString returns a JSON value as a string, numbers being formatted
+// without an exponent
+func jsonString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return ""
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// jsonBool returns a JSON value as a boolean, accepting "true" and "false"
+func jsonBool(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		b, _ := strconv.ParseBool(v)
+		return b
+	}
+	return false
+}
+
+func jsonAnnotations(port *gabs.Container) map[string]string {
+	annotations := make(map[string]string)
+	children, _ := port.Path("annotations").ChildrenMap()
+	for key, value := range children {
+		annotations[key] = jsonString(value.Data())
+	}
+	return annotations
+}
+
+// flowCriteriaValues returns the value of the given field of each of the criteria
+// of a flow, by type
+func flowCriteriaValues(flow *gabs.Container, fields map[string]string) map[string]interface{} {
+	values := make(map[string]interface{})
+	criteria, _ := flow.Path("selector.criteria").Children()
+	for _, criterion := range criteria {
+		kind := jsonString(criterion.Path("type").Data())
+		if field, ok := fields[kind]; ok {
+			values[kind] = criterion.Path(field).Data()
+		}
+	}
+	return values
+}
+
+// flowItem returns a criterion or instruction of a flow with its port, if
+// any, decoded by the given function
+func flowItem(item *gabs.Container, port func(value interface{}) string) interface{} {
+	fields, ok := item.Data().(map[string]interface{})
+	if !ok {
+		return item.Data()
+	}
+	value, ok := fields["port"]
+	if !ok {
+		return fields
+	}
+	decoded := make(map[string]interface{}, len(fields))
+	for key, field := range fields {
+		decoded[key] = field
+	}
+	decoded["port"] = port(value)
+	return decoded
+}
+
+// matchFields are the fields of the criteria that hold the VLAN and in port
+var matchFields = map[string]string{"VLAN_VID": "vlanId", "IN_PORT": "port"}
+
+func decodeDevice(device *gabs.Container) Device {
+	return Device{
+		Id:         jsonString(device.Path("id").Data()),
+		Hw:         jsonString(device.Path("hw").Data()),
+		Driver:     jsonString(device.Path("driver").Data()),
+		Available:  jsonBool(device.Path("available").Data()),
+		LastUpdate: jsonString(device.Path("lastUpdate").Data()),
+	}
+}
+
+// legacyCodec decodes the JSON of ONOS 1.x, in which port numbers are
+// strings, other than in flow criteria, and the local port is "local"
+type legacyCodec struct{}
+
+func (codec *legacyCodec) Name() string {
+	return "onos-1.x"
+}
+
+func (codec *legacyCodec) Device(device *gabs.Container) Device {
+	return decodeDevice(device)
+}
+
+func (codec *legacyCodec) Port(port *gabs.Container) Port {
+	number := jsonString(port.Path("port").Data())
+	return Port{
+		Number:      number,
+		Enabled:     jsonBool(port.Path("isEnabled").Data()),
+		Local:       number == "local",
+		Annotations: jsonAnnotations(port),
+	}
+}
+
+func (codec *legacyCodec) FlowId(flow *gabs.Container) string {
+	return jsonString(flow.Path("id").Data())
+}
+
+func (codec *legacyCodec) FlowMatch(flow *gabs.Container) (string, string) {
+	values := flowCriteriaValues(flow, matchFields)
+	return jsonString(values["VLAN_VID"]), jsonString(values["IN_PORT"])
+}
+
+func (codec *legacyCodec) FlowItem(item *gabs.Container) interface{} {
+	return flowItem(item, jsonString)
+}
+
+// namedPort matches a port number qualified by the port's name, e.g.
+// "[eth1](1)"
+var namedPort = regexp.MustCompile(`^\[.*\]\((.+)\)$`)
+
+// currentPort returns a port number of ONOS 2.x as it is configured, without
+// the port's name and with the local port as "local"
+func currentPort(value interface{}) (string, bool) {
+	number := jsonString(value)
+	if match := namedPort.FindStringSubmatch(number); match != nil {
+		number = match[1]
+	}
+	if strings.EqualFold(number, "local") {
+		return "local", true
+	}
+	return number, false
+}
+
+// currentCodec decodes the JSON of ONOS 2.x and later, in which port numbers
+// may be numbers or qualified by the port's name, the local port may be
+// "LOCAL" and a flow that matches untagged traffic has the VLAN "None". It is
+// used when the version of ONOS is not known.
+type currentCodec struct{}
+
+func (codec *currentCodec) Name() string {
+	return "onos-2.x"
+}
+
+func (codec *currentCodec) Device(device *gabs.Container) Device {
+	return decodeDevice(device)
+}
+
+func (codec *currentCodec) Port(port *gabs.Container) Port {
+	number, local := currentPort(port.Path("port").Data())
+	return Port{
+		Number:      number,
+		Enabled:     jsonBool(port.Path("isEnabled").Data()),
+		Local:       local,
+		Annotations: jsonAnnotations(port),
+	}
+}
+
+func (codec *currentCodec) FlowId(flow *gabs.Container) string {
+	return jsonString(flow.Path("id").Data())
+}
+
+func (codec *currentCodec) FlowMatch(flow *gabs.Container) (string, string) {
+	values := flowCriteriaValues(flow, matchFields)
+	vlan := jsonString(values["VLAN_VID"])
+	if vlan == "None" {
+		vlan = ""
+	}
+	port, _ := currentPort(values["IN_PORT"])
+	return vlan, port
+}
+
+func (codec *currentCodec) FlowItem(item *gabs.Container) interface{} {
+	return flowItem(item, func(value interface{}) string {
+		number, _ := currentPort(value)
+		return number
+	})
+}
+
+// codecFor returns the codec for a version of ONOS, e.g. "2.7.0"
+func codecFor(version string) Codec {
+	major, err := strconv.Atoi(strings.SplitN(version, ".", 2)[0])
+	if err == nil && major < 2 {
+		return &legacyCodec{}
+	}
+	return &currentCodec{}
+}
+
+// detectVersion returns the version of ONOS. Versions from before the
+// system API was added do not report their version, and are taken to be 1.x.
+func (app *Application) detectVersion() (string, error) {
+	system, err := app.fetchJSON(fmt.Sprintf(SYSTEM_URL, app.OnosConnectUrl))
+	if status, ok := err.(*statusError); ok && status.code == http.StatusNotFound {
+		return "1.x", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("Unable to query ONOS version : %s", err)
+	}
+	version := jsonString(system.Path("version").Data())
+	if version == "" {
+		return "", fmt.Errorf("ONOS did not report its version")
+	}
+	return version, nil
+}
+
+/*
+ * codec returns the codec for the version of ONOS, which is detected the
+ * first time it is needed unless configured. Should detection fail the
+ * codec for the current version of ONOS is used, and detection is attempted
+ * again next time.
+ */
+func (app *Application) codec() Codec {
+	app.codecLock.Lock()
+	defer app.codecLock.Unlock()
+	if app.onosCodec != nil {
+		return app.onosCodec
+	}
+
+	version := app.OnosVersion
+	if version == VERSION_DETECT {
+		var err error
+		if version, err = app.detectVersion(); err != nil {
+			log.Warnf("%s, assuming a current version", err)
+			return &currentCodec{}
+		}
+	}
+	app.onosCodec = codecFor(version)
+	log.Infof("ONOS version %s, using codec %s", version, app.onosCodec.Name())
+	app.updateStatus(func(status *Status) {
+		status.OnosVersion = version
+	})
+	return app.onosCodec
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"github.com/Jeffail/gabs"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+/*
+ * Responses recorded from the ONOS REST API, trimmed to the fields that
+ * letmein uses, for each of the ONOS versions that the codecs decode.
+ */
+const (
+	legacySystem = `{"code":404,"message":"HTTP 404 Not Found"}`
+
+	legacyDevices = `{"devices":[
+		{"id":"of:0000000000000001","type":"SWITCH","available":true,"role":"MASTER",
+		 "mfr":"Nicira, Inc.","hw":"Open vSwitch","sw":"2.5.0","serial":"None",
+		 "driver":"ovs","chassisId":"1","lastUpdate":"1509035452385",
+		 "humanReadableLastUpdate":"connected 2m2s ago",
+		 "annotations":{"channelId":"10.0.0.2:48204","managementAddress":"10.0.0.2","protocol":"OF_13"}},
+		{"id":"of:0000000000000aaa","type":"SWITCH","available":false,"role":"MASTER",
+		 "mfr":"VOLTHA Project","hw":"asfvolt16","sw":"1.0","serial":"EC1721000216",
+		 "driver":"pmc-olt","chassisId":"aaa","lastUpdate":"1509035452380",
+		 "annotations":{"protocol":"OF_13"}}]}`
+
+	legacyPorts = `{"id":"of:0000000000000001","type":"SWITCH","available":true,"ports":[
+		{"element":"of:0000000000000001","port":"local","isEnabled":true,"type":"copper",
+		 "portSpeed":0,"annotations":{"portMac":"6a:8e:2b:c4:a3:4f","portName":"br-int"}},
+		{"element":"of:0000000000000001","port":"1","isEnabled":true,"type":"copper",
+		 "portSpeed":10000,"annotations":{"portMac":"d2:0e:7b:43:5f:8a","portName":"eth1"}},
+		{"element":"of:0000000000000001","port":"2","isEnabled":false,"type":"copper",
+		 "portSpeed":10000,"annotations":{"portMac":"a6:3c:1e:0b:72:19","portName":"eth2"}}]}`
+
+	legacyFlows = `{"flows":[
+		{"id":"45880000426375","tableId":0,"appId":"com.ciena","groupId":0,"priority":32768,
+		 "timeout":0,"isPermanent":true,"deviceId":"of:0000000000000001","state":"ADDED",
+		 "life":132,"packets":12,"bytes":1440,"lastSeen":1509035584402,
+		 "treatment":{"instructions":[{"type":"OUTPUT","port":"CONTROLLER"}],"deferred":[]},
+		 "selector":{"criteria":[{"type":"IN_PORT","port":1},{"type":"VLAN_VID","vlanId":100}]}}]}`
+
+	currentSystem = `{"version":"2.7.0","clusterId":"default","nodes":3,"apps":42,"devices":2,"links":1,
+		"hosts":0,"sccs":1,"flows":18,"intents":0,"topologyChanges":12}`
+
+	currentDevices = `{"devices":[
+		{"id":"of:0000000000000001","type":"SWITCH","available":true,"role":"MASTER",
+		 "mfr":"Nicira, Inc.","hw":"Open vSwitch","sw":"2.13.1","serial":"None",
+		 "driver":"ovs","chassisId":"1","lastUpdate":"1693816125671",
+		 "humanReadableLastUpdate":"connected 4m ago",
+		 "annotations":{"channelId":"10.0.0.2:40876","datapathDescription":"None",
+		  "managementAddress":"10.0.0.2","protocol":"OF_14"}}]}`
+
+	currentPorts = `{"id":"of:0000000000000001","type":"SWITCH","available":true,"ports":[
+		{"element":"of:0000000000000001","port":"LOCAL","isEnabled":true,"type":"copper",
+		 "portSpeed":0,"annotations":{"adminState":"disabled","portMac":"6a:8e:2b:c4:a3:4f","portName":"br-int"}},
+		{"element":"of:0000000000000001","port":"[eth1](1)","isEnabled":true,"type":"copper",
+		 "portSpeed":10000,"annotations":{"adminState":"enabled","portMac":"d2:0e:7b:43:5f:8a","portName":"eth1"}},
+		{"element":"of:0000000000000001","port":2,"isEnabled":true,"type":"fiber",
+		 "portSpeed":25000,"annotations":{"adminState":"enabled","portMac":"a6:3c:1e:0b:72:19","portName":"eth2"}}]}`
+
+	currentFlows = `{"flows":[
+		{"id":"281475339451457","tableId":"0","appId":"com.ciena","groupId":0,"priority":32768,
+		 "timeout":0,"isPermanent":true,"deviceId":"of:0000000000000001","state":"ADDED",
+		 "life":88,"liveType":"UNKNOWN","packets":0,"bytes":0,"lastSeen":1693816214330,
+		 "treatment":{"instructions":[{"type":"OUTPUT","port":"CONTROLLER"}],"deferred":[],"clearDeferred":true},
+		 "selector":{"criteria":[{"type":"IN_PORT","port":"[eth1](1)"},{"type":"VLAN_VID","vlanId":"200"}]}},
+		{"id":"281475339451458","tableId":"0","appId":"org.onosproject.core","groupId":0,"priority":40000,
+		 "timeout":0,"isPermanent":true,"deviceId":"of:0000000000000001","state":"ADDED",
+		 "treatment":{"instructions":[{"type":"OUTPUT","port":"CONTROLLER"}],"deferred":[],"clearDeferred":true},
+		 "selector":{"criteria":[{"type":"IN_PORT","port":"LOCAL"},{"type":"VLAN_VID","vlanId":"None"}]}}]}`
+
+	// A response in which every field used is of an unexpected type
+	mistyped = `{"devices":[{"id":1,"hw":["Open vSwitch"],"driver":null,"available":"yes","lastUpdate":{}}],
+		"ports":[{"port":["1"],"isEnabled":1,"annotations":"eth1"}],
+		"flows":[{"id":{"value":1},"selector":{"criteria":[{"type":"IN_PORT","port":{}},{"type":"VLAN_VID","vlanId":[100]}]}},
+		 {"id":null,"selector":{"criteria":"IN_PORT"}},{"selector":null}]}`
+)
+
+func children(t *testing.T, payload, path string) []*gabs.Container {
+	wrapper, err := gabs.ParseJSON([]byte(payload))
+	if err != nil {
+		t.Fatalf("Unable to parse recorded payload : %s", err)
+	}
+	items, err := wrapper.Path(path).Children()
+	if err != nil {
+		t.Fatalf("Recorded payload has no %s : %s", path, err)
+	}
+	return items
+}
+
+func TestDetectVersion(t *testing.T) {
+	for _, test := range []struct {
+		status  int
+		body    string
+		version string
+		codec   string
+	}{
+		{http.StatusNotFound, legacySystem, "1.x", "onos-1.x"},
+		{http.StatusOK, currentSystem, "2.7.0", "onos-2.x"},
+		{http.StatusOK, `{"version":"1.13.2"}`, "1.13.2", "onos-1.x"},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != "/onos/v1/system" {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		}))
+		app := newApplication()
+		app.OnosConnectUrl = server.URL
+		version, err := app.detectVersion()
+		server.Close()
+		if err != nil {
+			t.Errorf("Unable to detect version from %s : %s", test.body, err)
+			continue
+		}
+		if version != test.version {
+			t.Errorf("Detected version %s, expected %s", version, test.version)
+		}
+		if name := codecFor(version).Name(); name != test.codec {
+			t.Errorf("Version %s uses codec %s, expected %s", version, name, test.codec)
+		}
+	}
+}
+
+func TestDetectVersionUnreported(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"version":null}`))
+	}))
+	defer server.Close()
+	app := newApplication()
+	app.OnosConnectUrl = server.URL
+	if version, err := app.detectVersion(); err == nil {
+		t.Errorf("Detected version %s when none was reported", version)
+	}
+}
+
+func TestDevices(t *testing.T) {
+	for _, test := range []struct {
+		codec   Codec
+		payload string
+		devices []Device
+	}{
+		{&legacyCodec{}, legacyDevices, []Device{
+			{Id: "of:0000000000000001", Hw: "Open vSwitch", Driver: "ovs", Available: true, LastUpdate: "1509035452385"},
+			{Id: "of:0000000000000aaa", Hw: "asfvolt16", Driver: "pmc-olt", Available: false, LastUpdate: "1509035452380"},
+		}},
+		{&currentCodec{}, currentDevices, []Device{
+			{Id: "of:0000000000000001", Hw: "Open vSwitch", Driver: "ovs", Available: true, LastUpdate: "1693816125671"},
+		}},
+	} {
+		devices := []Device{}
+		for _, device := range children(t, test.payload, "devices") {
+			devices = append(devices, test.codec.Device(device))
+		}
+		if !reflect.DeepEqual(devices, test.devices) {
+			t.Errorf("Codec %s decoded devices %+v, expected %+v", test.codec.Name(), devices, test.devices)
+		}
+	}
+}
+
+func TestPorts(t *testing.T) {
+	for _, test := range []struct {
+		codec   Codec
+		payload string
+		ports   []Port
+	}{
+		{&legacyCodec{}, legacyPorts, []Port{
+			{Number: "local", Enabled: true, Local: true,
+				Annotations: map[string]string{"portMac": "6a:8e:2b:c4:a3:4f", "portName": "br-int"}},
+			{Number: "1", Enabled: true,
+				Annotations: map[string]string{"portMac": "d2:0e:7b:43:5f:8a", "portName": "eth1"}},
+			{Number: "2", Enabled: false,
+				Annotations: map[string]string{"portMac": "a6:3c:1e:0b:72:19", "portName": "eth2"}},
+		}},
+		{&currentCodec{}, currentPorts, []Port{
+			{Number: "local", Enabled: true, Local: true,
+				Annotations: map[string]string{"adminState": "disabled", "portMac": "6a:8e:2b:c4:a3:4f", "portName": "br-int"}},
+			{Number: "1", Enabled: true,
+				Annotations: map[string]string{"adminState": "enabled", "portMac": "d2:0e:7b:43:5f:8a", "portName": "eth1"}},
+			{Number: "2", Enabled: true,
+				Annotations: map[string]string{"adminState": "enabled", "portMac": "a6:3c:1e:0b:72:19", "portName": "eth2"}},
+		}},
+	} {
+		ports := []Port{}
+		for _, port := range children(t, test.payload, "ports") {
+			ports = append(ports, test.codec.Port(port))
+		}
+		if !reflect.DeepEqual(ports, test.ports) {
+			t.Errorf("Codec %s decoded ports %+v, expected %+v", test.codec.Name(), ports, test.ports)
+		}
+	}
+}
+
+func TestFlows(t *testing.T) {
+	type flow struct {
+		id, vlan, port string
+	}
+	for _, test := range []struct {
+		codec   Codec
+		payload string
+		flows   []flow
+	}{
+		{&legacyCodec{}, legacyFlows, []flow{
+			{"45880000426375", "100", "1"},
+		}},
+		{&currentCodec{}, currentFlows, []flow{
+			{"281475339451457", "200", "1"},
+			{"281475339451458", "", "local"},
+		}},
+	} {
+		flows := []flow{}
+		for _, child := range children(t, test.payload, "flows") {
+			vlan, port := test.codec.FlowMatch(child)
+			flows = append(flows, flow{test.codec.FlowId(child), vlan, port})
+		}
+		if !reflect.DeepEqual(flows, test.flows) {
+			t.Errorf("Codec %s decoded flows %+v, expected %+v", test.codec.Name(), flows, test.flows)
+		}
+	}
+}
+
+// TestMistyped checks that fields of unexpected types are decoded without
+// panicking, to values that do not match those of a real switch or flow
+func TestMistyped(t *testing.T) {
+	for _, codec := range []Codec{&legacyCodec{}, &currentCodec{}} {
+		for _, child := range children(t, mistyped, "devices") {
+			device := codec.Device(child)
+			if device.Hw == "Open vSwitch" || device.Driver != "" || device.Available {
+				t.Errorf("Codec %s decoded mistyped device as %+v", codec.Name(), device)
+			}
+		}
+		for _, child := range children(t, mistyped, "ports") {
+			port := codec.Port(child)
+			if port.Number == "1" || port.Enabled || port.Local || len(port.Annotations) != 0 {
+				t.Errorf("Codec %s decoded mistyped port as %+v", codec.Name(), port)
+			}
+		}
+		for _, child := range children(t, mistyped, "flows") {
+			codec.FlowId(child)
+			if vlan, port := codec.FlowMatch(child); vlan == "100" || port == "1" {
+				t.Errorf("Codec %s decoded mistyped flow as VLAN %s port %s", codec.Name(), vlan, port)
+			}
+		}
+	}
+}
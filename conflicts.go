@@ -0,0 +1,204 @@
+package main
+
+import (
+	"github.com/Jeffail/gabs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	CONFLICT_OFF  = "off"
+	CONFLICT_WARN = "warn"
+	CONFLICT_FAIL = "fail"
+
+	CONFLICT_SHADOWS   = "shadows"
+	CONFLICT_OVERLAPS  = "overlaps"
+	CONFLICT_AMBIGUOUS = "ambiguous"
+)
+
+// FlowSummary describes a flow in a conflict
+type FlowSummary struct {
+	Id        string `json:"id,omitempty"`
+	AppId     string `json:"appId"`
+	Priority  string `json:"priority"`
+	Selector  string `json:"selector"`
+	Treatment string `json:"treatment"`
+}
+
+func summarize(codec Codec, flow *gabs.Container) FlowSummary {
+	appId, _ := flow.Path(KEY_APP_ID).Data().(string)
+	return FlowSummary{
+		Id:        canonical(flow.Path("id").Data()),
+		AppId:     appId,
+		Priority:  canonical(flow.Path("priority").Data()),
+		Selector:  flowSelector(codec, flow),
+		Treatment: flowInstructions(codec, flow),
+	}
+}
+
+// Conflict is a flow of another application that matches some or all of the
+// traffic of one of letmein's rules, with equal or higher priority
+type Conflict struct {
+	Vlan      string      `json:"vlan"`
+	Direction string      `json:"direction"`
+	Kind      string      `json:"kind"`
+	Drops     bool        `json:"drops"`
+	Rule      FlowSummary `json:"rule"`
+	Flow      FlowSummary `json:"flow"`
+}
+
+func (conflict *Conflict) key() string {
+	return conflict.Vlan + "/" + conflict.Direction + "/" + conflict.Flow.Id
+}
+
+// flowCriteria returns the criteria of a flow in canonical form, decoded by
+// the codec for the version of ONOS, by type
+func flowCriteria(codec Codec, flow *gabs.Container) map[string]string {
+	criteria := make(map[string]string)
+	children, _ := flow.Path("selector.criteria").Children()
+	for _, criterion := range children {
+		criteria[canonical(criterion.Path("type").Data())] = canonical(codec.FlowItem(criterion))
+	}
+	return criteria
+}
+
+// overlaps returns true if some traffic could match both sets of criteria,
+// i.e. they do not require different values of any field
+func overlaps(a, b map[string]string) bool {
+	for kind, value := range a {
+		if other, ok := b[kind]; ok && other != value {
+			return false
+		}
+	}
+	return true
+}
+
+// covers returns true if all the traffic matched by specific is also matched
+// by general, i.e. every criterion of general is also a criterion of specific
+func covers(general, specific map[string]string) bool {
+	for kind, value := range general {
+		if specific[kind] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// flowPriority returns the priority of a flow as a number
+func flowPriority(flow *gabs.Container) float64 {
+	priority, _ := strconv.ParseFloat(canonical(flow.Path("priority").Data()), 64)
+	return priority
+}
+
+// flowDrops returns true if a flow drops the traffic it matches
+func flowDrops(flow *gabs.Container) bool {
+	instructions, _ := flow.Path("treatment.instructions").Children()
+	for _, instruction := range instructions {
+		switch instruction.Path("type").Data() {
+		case "OUTPUT", "TABLE", "GROUP", "QUEUE":
+			return false
+		}
+	}
+	return true
+}
+
+// flowOutcome returns a canonical description of what a flow does with the
+// traffic it matches, other than metering it
+func flowOutcome(codec Codec, flow *gabs.Container) string {
+	parts := []string{}
+	instructions, _ := flow.Path("treatment.instructions").Children()
+	for _, instruction := range instructions {
+		if instruction.Path("type").Data() != "METER" {
+			parts = append(parts, canonical(codec.FlowItem(instruction)))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+/*
+ * findConflicts checks the flows of other applications on the switch for any
+ * that match traffic that one of letmein's rules should match, in the same
+ * table, with an equal or higher priority. Such a flow makes letmein's rule
+ * useless, either entirely when it matches all of the rule's traffic with a
+ * higher priority (it shadows the rule), or partially. With equal priority
+ * which of the flows applies is undefined. A flow that does the same with the
+ * traffic as the rule, e.g. the flows with which ONOS punts LLDP and ARP when
+ * letmein is punting, is not a conflict.
+ */
+func findConflicts(codec Codec, desired []*DesiredFlow, flows []*gabs.Container) []Conflict {
+	conflicts := []Conflict{}
+	for _, rule := range desired {
+		ours := flowCriteria(codec, rule.Flow)
+		priority := flowPriority(rule.Flow)
+		for _, flow := range flows {
+			if flowTable(flow) != flowTable(rule.Flow) || flowPriority(flow) < priority {
+				continue
+			}
+			theirs := flowCriteria(codec, flow)
+			if !overlaps(ours, theirs) || flowOutcome(codec, flow) == flowOutcome(codec, rule.Flow) {
+				continue
+			}
+			kind := CONFLICT_OVERLAPS
+			switch {
+			case flowPriority(flow) == priority:
+				kind = CONFLICT_AMBIGUOUS
+			case covers(theirs, ours):
+				kind = CONFLICT_SHADOWS
+			}
+			conflicts = append(conflicts, Conflict{
+				Vlan:      rule.Vlan,
+				Direction: rule.Direction,
+				Kind:      kind,
+				Drops:     flowDrops(flow),
+				Rule:      summarize(codec, rule.Flow),
+				Flow:      summarize(codec, flow),
+			})
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].key() < conflicts[j].key()
+	})
+	return conflicts
+}
+
+// checkConflicts finds the flows of other applications that conflict with
+// the rules, logging those that are new or have been resolved since the last
+// check, and records them in the status
+func (app *Application) checkConflicts(desired []*DesiredFlow, foreign []*gabs.Container) int {
+	conflicts := findConflicts(app.codec(), desired, foreign)
+
+	found := make(map[string]bool)
+	for _, conflict := range conflicts {
+		key := conflict.key()
+		found[key] = true
+		if app.conflicts[key] {
+			continue
+		}
+		action := "matches some of the traffic of"
+		switch conflict.Kind {
+		case CONFLICT_SHADOWS:
+			action = "shadows"
+		case CONFLICT_AMBIGUOUS:
+			action = "has the same priority as, and overlaps,"
+		}
+		if conflict.Drops {
+			action = "drops and " + action
+		}
+		log.Warnf("[CONFLICT] Flow %s of application %s (priority %s, match %s, instructions %s) %s the %s rule for VLAN %s (priority %s, match %s, instructions %s)",
+			conflict.Flow.Id, conflict.Flow.AppId, conflict.Flow.Priority, conflict.Flow.Selector, conflict.Flow.Treatment,
+			action, conflict.Direction, conflict.Vlan, conflict.Rule.Priority, conflict.Rule.Selector, conflict.Rule.Treatment)
+	}
+	for key := range app.conflicts {
+		if !found[key] {
+			log.Infof("[RESOLVED] Conflict %s no longer exists", key)
+		}
+	}
+	app.conflicts = found
+
+	metrics.Set("letmein_flow_conflicts", float64(len(conflicts)))
+	app.updateStatus(func(status *Status) {
+		status.Conflicts = conflicts
+	})
+	return len(conflicts)
+}
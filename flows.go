@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Jeffail/gabs"
+	"io"
+	"net/http"
+)
+
+const (
+	APP_FLOWS_URL = "%s/onos/v1/flows/application/%s"
+)
+
+/*
+ * streamFlows decodes a flows response, i.e. {"flows": [...]}, one flow at a
+ * time rather than as a whole so that memory use is bounded by the flows that
+ * are kept, not the size of the response. Only the flows for which keep
+ * returns true are returned.
+ */
+func streamFlows(r io.Reader, keep func(flow map[string]interface{}) bool) ([]*gabs.Container, error) {
+	decoder := json.NewDecoder(r)
+	if token, err := decoder.Token(); err != nil {
+		return nil, err
+	} else if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return nil, fmt.Errorf("expected JSON object, found %v", token)
+	}
+
+	flows := []*gabs.Container{}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		if key, ok := token.(string); !ok || key != FLOWS {
+			// Not the flows, skip over the value
+			var skip json.RawMessage
+			if err := decoder.Decode(&skip); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if token, err := decoder.Token(); err != nil {
+			return nil, err
+		} else if delim, ok := token.(json.Delim); !ok || delim != '[' {
+			return nil, fmt.Errorf("expected array of flows, found %v", token)
+		}
+		for decoder.More() {
+			var flow map[string]interface{}
+			if err := decoder.Decode(&flow); err != nil {
+				return nil, err
+			}
+			if !keep(flow) {
+				continue
+			}
+			wrapper, err := gabs.Consume(flow)
+			if err != nil {
+				return nil, err
+			}
+			flows = append(flows, wrapper)
+		}
+		if _, err := decoder.Token(); err != nil {
+			return nil, err
+		}
+	}
+	return flows, nil
+}
+
+/*
+ * managedFlows returns the flows on the switch that were created by letmein.
+ * Where ONOS supports it the flows are fetched by application, so that the
+ * flows of other applications are not transferred. Older versions of ONOS,
+ * which do not support this, fall back to fetching all the flows of the switch.
+ * ONOS also answers not found while letmein's application ID is not yet
+ * registered, e.g. on a fresh install, so only a method not allowed response
+ * stops letmein asking by application.
+ */
+func (app *Application) managedFlows(dpid string) ([]*gabs.Container, error) {
+	keep := func(flow map[string]interface{}) bool {
+		appId, _ := flow[KEY_APP_ID].(string)
+		deviceId, _ := flow["deviceId"].(string)
+		return appId == APP_ID && (deviceId == "" || deviceId == dpid)
+	}
+
+	if !app.noAppFlows {
+		resp, err := app.client.Get(fmt.Sprintf(APP_FLOWS_URL, app.OnosConnectUrl, APP_ID))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read ONOS flows for application %s : %s", APP_ID, err)
+		}
+		defer resp.Body.Close()
+		switch {
+		case resp.StatusCode == http.StatusMethodNotAllowed:
+			log.Infof("ONOS does not support querying flows by application (%s), querying flows by switch", resp.Status)
+			app.noAppFlows = true
+		case resp.StatusCode == http.StatusNotFound:
+			/*
+			 * ONOS 2.x supports querying by application, so the application
+			 * is not registered and has no flows. A 1.x ONOS may not support
+			 * it, so this time its flows are queried by switch.
+			 */
+			if _, legacy := app.codec().(*legacyCodec); !legacy {
+				log.Debugf("Application %s is not registered with ONOS (%s), it has no flows", APP_ID, resp.Status)
+				return []*gabs.Container{}, nil
+			}
+			log.Debugf("Unable to query flows by application (%s), querying flows by switch", resp.Status)
+		case int(resp.StatusCode/100) != 2:
+			return nil, fmt.Errorf("Unable to query ONOS flows for application %s : %s", APP_ID, resp.Status)
+		default:
+			flows, err := streamFlows(resp.Body, keep)
+			if err != nil {
+				return nil, fmt.Errorf("Unable to decode ONOS flows for application %s : %s", APP_ID, err)
+			}
+			return flows, nil
+		}
+	}
+
+	resp, err := app.client.Get(fmt.Sprintf(FLOWS_URL, app.OnosConnectUrl, dpid))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read ONOS flows for switch %s : %s", dpid, err)
+	}
+	defer resp.Body.Close()
+	if int(resp.StatusCode/100) != 2 {
+		return nil, fmt.Errorf("Unable to query ONOS flows for switch %s : %s", dpid, resp.Status)
+	}
+	flows, err := streamFlows(resp.Body, keep)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode ONOS flows for switch %s : %s", dpid, err)
+	}
+	return flows, nil
+}
+
+/*
+ * switchFlows returns the flows on the switch that were created by letmein
+ * and those of other applications, from a single listing of the switch's
+ * flows. It is used instead of managedFlows when the flows of other
+ * applications are also needed.
+ */
+func (app *Application) switchFlows(dpid string) ([]*gabs.Container, []*gabs.Container, error) {
+	resp, err := app.client.Get(fmt.Sprintf(FLOWS_URL, app.OnosConnectUrl, dpid))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to read ONOS flows for switch %s : %s", dpid, err)
+	}
+	defer resp.Body.Close()
+	if int(resp.StatusCode/100) != 2 {
+		return nil, nil, fmt.Errorf("Unable to query ONOS flows for switch %s : %s", dpid, resp.Status)
+	}
+	flows, err := streamFlows(resp.Body, func(flow map[string]interface{}) bool {
+		return true
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to decode ONOS flows for switch %s : %s", dpid, err)
+	}
+
+	managed, foreign := []*gabs.Container{}, []*gabs.Container{}
+	for _, flow := range flows {
+		if appId, _ := flow.Path(KEY_APP_ID).Data().(string); appId == APP_ID {
+			managed = append(managed, flow)
+		} else {
+			foreign = append(foreign, flow)
+		}
+	}
+	return managed, foreign, nil
+}
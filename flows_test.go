@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// TestManagedFlows checks that flows are fetched by switch when ONOS does not
+// answer by application, and that only ONOS not supporting it stops letmein
+// asking by application
+func TestManagedFlows(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		version    string
+		status     int
+		flows      int
+		noAppFlows bool
+	}{
+		{"2.x by application", "2.7.0", http.StatusOK, 1, false},
+		{"2.x not registered", "2.7.0", http.StatusNotFound, 0, false},
+		{"1.x not found", "1.13.2", http.StatusNotFound, 1, false},
+		{"not supported", "2.7.0", http.StatusMethodNotAllowed, 1, true},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/onos/v1/flows/application/" + APP_ID:
+				w.WriteHeader(test.status)
+				if test.status == http.StatusOK {
+					w.Write([]byte(legacyFlows))
+				}
+			case "/onos/v1/flows/of:0000000000000001":
+				w.Write([]byte(legacyFlows))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		app := newApplication()
+		app.OnosConnectUrl = server.URL
+		app.OnosVersion = test.version
+		flows, err := app.managedFlows("of:0000000000000001")
+		server.Close()
+		if err != nil {
+			t.Errorf("%s: unable to fetch flows : %s", test.name, err)
+			continue
+		}
+		if len(flows) != test.flows {
+			t.Errorf("%s: fetched %d flows, expected %d", test.name, len(flows), test.flows)
+		}
+		if app.noAppFlows != test.noAppFlows {
+			t.Errorf("%s: querying by application disabled %t, expected %t", test.name, app.noAppFlows, test.noAppFlows)
+		}
+	}
+}
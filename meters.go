@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Jeffail/gabs"
+	"net/http"
+	"path"
+	"sort"
+)
+
+const (
+	METERS_URL       = "%s/onos/v1/meters/%s"
+	DELETE_METER_URL = "%s/onos/v1/meters/%s/%s"
+
+	METER_VLAN   = "vlan"
+	METER_SWITCH = "switch"
+
+	METER_PACKETS  = "PKTS_PER_SEC"
+	METER_KILOBITS = "KB_PER_SEC"
+	METER_FAILED   = "FAILED"
+)
+
+// flowMeter returns the ID of the meter referenced by a flow, if any
+func flowMeter(flow *gabs.Container) string {
+	instructions, _ := flow.Path("treatment.instructions").Children()
+	for _, instruction := range instructions {
+		if instruction.Path("type").Data() == "METER" {
+			return canonical(instruction.Path("meterId").Data())
+		}
+	}
+	return ""
+}
+
+// meterKey returns the key identifying the meter that limits a VLAN, which
+// is either the VLAN itself or the switch as a whole
+func (app *Application) meterKey(vlan string) string {
+	if app.MeterMode == METER_SWITCH {
+		return METER_SWITCH
+	}
+	return vlan
+}
+
+// meterMatches returns true if an existing meter enforces the configured rate
+func (app *Application) meterMatches(meter *gabs.Container) bool {
+	if state, _ := meter.Path("state").Data().(string); state == METER_FAILED {
+		return false
+	}
+	bands, _ := meter.Path("bands").Children()
+	return canonical(meter.Path("unit").Data()) == app.MeterUnit && len(bands) == 1 &&
+		canonical(bands[0].Path("type").Data()) == "DROP" &&
+		canonical(bands[0].Path("rate").Data()) == fmt.Sprintf("%d", app.MeterRate) &&
+		canonical(bands[0].Path("burstSize").Data()) == fmt.Sprintf("%d", app.MeterBurst)
+}
+
+// deviceMeters returns the meters of a switch, by ID
+func (app *Application) deviceMeters(dpid string) (map[string]*gabs.Container, error) {
+	wrapper, err := app.fetchJSON(fmt.Sprintf(METERS_URL, app.OnosConnectUrl, dpid))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query meters of switch %s : %s", dpid, err)
+	}
+	meters := make(map[string]*gabs.Container)
+	children, _ := wrapper.Path("meters").Children()
+	for _, meter := range children {
+		meters[canonical(meter.Path("id").Data())] = meter
+	}
+	return meters, nil
+}
+
+// createMeter creates a meter with the configured rate and returns its ID
+func (app *Application) createMeter(dpid string) (string, error) {
+	meter := map[string]interface{}{
+		"deviceId": dpid,
+		"appId":    APP_ID,
+		"unit":     app.MeterUnit,
+		"burst":    true,
+		"bands": []interface{}{
+			map[string]interface{}{
+				"type":      "DROP",
+				"rate":      app.MeterRate,
+				"burstSize": app.MeterBurst,
+			},
+		},
+	}
+	body, err := json.Marshal(meter)
+	if err != nil {
+		return "", err
+	}
+	resp, err := app.client.Post(fmt.Sprintf(METERS_URL, app.OnosConnectUrl, dpid), "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("Unable to create meter on switch %s : %s", dpid, err)
+	}
+	defer resp.Body.Close()
+	if int(resp.StatusCode/100) != 2 {
+		return "", fmt.Errorf("Error response code while creating meter on switch %s : %s", dpid, resp.Status)
+	}
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return "", fmt.Errorf("ONOS did not return the ID of the meter created on switch %s", dpid)
+	}
+	id := path.Base(location)
+	app.meters[id] = true
+	metrics.Inc("letmein_meters_created_total")
+	return id, nil
+}
+
+/*
+ * assignMeters determines the meter that limits the traffic of each VLAN,
+ * creating meters where needed. Meters that already enforce the configured
+ * rate are reused, preferring the one that the VLAN's rule already references,
+ * so that flows are only changed when the rate changes. The meters belonging
+ * to letmein, i.e. those created by it or referenced by its flows, are returned
+ * so that those no longer used can be removed.
+ */
+func (app *Application) assignMeters(dpid string, owners map[string]string, flows []*gabs.Container) (map[string]string, map[string]bool, error) {
+	meters, err := app.deviceMeters(dpid)
+	if err != nil {
+		return nil, nil, err
+	}
+	owned := make(map[string]bool)
+	for id, meter := range meters {
+		if appId, _ := meter.Path(KEY_APP_ID).Data().(string); appId == APP_ID || app.meters[id] {
+			owned[id] = true
+		}
+	}
+
+	current := make(map[string]string)
+	used := make(map[string]bool)
+	for _, flow := range flows {
+		id := flowMeter(flow)
+		meter, ok := meters[id]
+		if !ok {
+			continue
+		}
+		owned[id] = true
+		vlan, _ := app.codec().FlowMatch(flow)
+		key := app.meterKey(vlan)
+		if _, ok := current[key]; !ok && !used[id] && app.meterMatches(meter) {
+			current[key] = id
+			used[id] = true
+		}
+	}
+
+	vlans := make([]string, 0, len(owners))
+	for vlan := range owners {
+		vlans = append(vlans, vlan)
+	}
+	sort.Strings(vlans)
+
+	assigned := make(map[string]string, len(owners))
+	for _, vlan := range vlans {
+		key := app.meterKey(vlan)
+		id, ok := current[key]
+		if !ok {
+			for candidate := range owned {
+				if meter, ok := meters[candidate]; ok && !used[candidate] && app.meterMatches(meter) {
+					id = candidate
+					break
+				}
+			}
+		}
+		if id == "" {
+			if app.observing() {
+				log.Infof("[CREATE] meter for %s", key)
+				continue
+			}
+			id, err = app.createMeter(dpid)
+			if err != nil {
+				return nil, nil, err
+			}
+			log.Infof("[CREATE] meter %s for %s", id, key)
+			owned[id] = true
+		}
+		current[key] = id
+		used[id] = true
+		assigned[vlan] = id
+	}
+	return assigned, owned, nil
+}
+
+// removeMeters deletes the meters belonging to letmein that are no longer
+// referenced by any rule
+func (app *Application) removeMeters(dpid string, assigned map[string]string, owned map[string]bool) {
+	used := make(map[string]bool)
+	for _, id := range assigned {
+		used[id] = true
+	}
+	for id := range owned {
+		if used[id] {
+			continue
+		}
+		log.Infof("[DELETE]: meter %s : no longer referenced", id)
+		if app.observing() {
+			continue
+		}
+		req, err := http.NewRequest(http.MethodDelete, fmt.Sprintf(DELETE_METER_URL, app.OnosConnectUrl, dpid, id), nil)
+		if err != nil {
+			log.Errorf("Unable to create request to delete meter %s : %s", id, err)
+			continue
+		}
+		resp, err := app.client.Do(req)
+		if err != nil {
+			log.Errorf("Unable to delete meter %s from switch %s : %s", id, dpid, err)
+			continue
+		}
+		resp.Body.Close()
+		if int(resp.StatusCode/100) != 2 && resp.StatusCode != http.StatusNotFound {
+			log.Errorf("Error response code while deleting meter %s from switch %s : %s", id, dpid, resp.Status)
+			continue
+		}
+		delete(app.meters, id)
+		metrics.Inc("letmein_meters_deleted_total")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	COUNTER = "counter"
+	GAUGE   = "gauge"
+)
+
+type metricInfo struct {
+	kind string
+	help string
+}
+
+// metricDefs describes each metric letmein exports
+var metricDefs = map[string]metricInfo{
+	"letmein_switch_available":              {GAUGE, "Whether the managed switch is available in ONOS"},
+	"letmein_switch_epoch":                  {GAUGE, "Number of times the managed switch has (re)connected"},
+	"letmein_switch_reconnects_total":       {COUNTER, "Number of times the managed switch has reconnected"},
+	"letmein_restore_seconds":               {GAUGE, "Time taken to restore flows after the most recent switch reconnect"},
+	"letmein_restore_seconds_sum":           {COUNTER, "Total time taken to restore flows after switch reconnects"},
+	"letmein_restore_seconds_count":         {COUNTER, "Number of flow restorations after switch reconnects"},
+	"letmein_sync_total":                    {COUNTER, "Number of synchronizations performed"},
+	"letmein_sync_failures_total":           {COUNTER, "Number of synchronizations that failed"},
+	"letmein_sync_duration_seconds":         {GAUGE, "Time taken by the most recent synchronization"},
+	"letmein_flows_created_total":           {COUNTER, "Number of flow rules created"},
+	"letmein_flows_deleted_total":           {COUNTER, "Number of flow rules deleted"},
+	"letmein_flow_change_errors_total":      {COUNTER, "Number of flow rule changes that failed"},
+	"letmein_duplicate_flows_removed_total": {COUNTER, "Number of duplicate managed flow rules removed"},
+	"letmein_meters_created_total":          {COUNTER, "Number of meters created"},
+	"letmein_meters_deleted_total":          {COUNTER, "Number of meters deleted"},
+	"letmein_vlan_packets_per_second":       {GAUGE, "Rate of packets matched by the rules of each VLAN"},
+	"letmein_vlan_bytes_per_second":         {GAUGE, "Rate of bytes matched by the rules of each VLAN"},
+	"letmein_flow_conflicts":                {GAUGE, "Number of flows of other applications that conflict with rules"},
+	"letmein_vlan_idle":                     {GAUGE, "Whether the rules of each VLAN have seen no traffic for the idle period"},
+}
+
+// Metrics is a minimal registry of values exported in the Prometheus text
+// format. Values are keyed by metric name and label set.
+type Metrics struct {
+	sync.Mutex
+	values map[string]map[string]float64
+}
+
+var metrics = &Metrics{values: make(map[string]map[string]float64)}
+
+// labelKey renders label name/value pairs as a Prometheus label set
+func labelKey(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Set sets the value of a metric, labels are given as name, value pairs
+func (m *Metrics) Set(name string, value float64, labels ...string) {
+	m.Lock()
+	defer m.Unlock()
+	if m.values[name] == nil {
+		m.values[name] = make(map[string]float64)
+	}
+	m.values[name][labelKey(labels)] = value
+}
+
+// Add adds to the value of a metric, labels are given as name, value pairs
+func (m *Metrics) Add(name string, value float64, labels ...string) {
+	m.Lock()
+	defer m.Unlock()
+	if m.values[name] == nil {
+		m.values[name] = make(map[string]float64)
+	}
+	m.values[name][labelKey(labels)] += value
+}
+
+// Inc increments the value of a metric by one
+func (m *Metrics) Inc(name string, labels ...string) {
+	m.Add(name, 1, labels...)
+}
+
+// Delete removes a labelled value of a metric, e.g. for a VLAN that is no
+// longer managed
+func (m *Metrics) Delete(name string, labels ...string) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.values[name], labelKey(labels))
+}
+
+// Expose writes the metrics in the Prometheus text exposition format
+func (m *Metrics) Expose(w io.Writer) {
+	m.Lock()
+	defer m.Unlock()
+	names := []string{}
+	for name := range m.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if info, ok := metricDefs[name]; ok {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, info.help, name, info.kind)
+		}
+		keys := []string{}
+		for key := range m.values[name] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Fprintf(w, "%s%s %g\n", name, key, m.values[name][key])
+		}
+	}
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.Expose(w)
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	OVERRIDE_PIN     = "pin"
+	OVERRIDE_EXCLUDE = "exclude"
+
+	SOURCE_OVERRIDE = "override:pin"
+)
+
+// Override is an operator's decision to require rules for VLANs regardless of
+// the desired state (pin), or never to have rules for them (exclude)
+type Override struct {
+	Vlans   string     `json:"vlans"`
+	Action  string     `json:"action"`
+	Reason  string     `json:"reason,omitempty"`
+	Created time.Time  `json:"created"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// expired returns true if the override no longer applies
+func (override *Override) expired(now time.Time) bool {
+	return override.Expires != nil && !now.Before(*override.Expires)
+}
+
+// validate checks that the override can be applied
+func (override *Override) validate() error {
+	if override.Action != OVERRIDE_PIN && override.Action != OVERRIDE_EXCLUDE {
+		return fmt.Errorf("invalid action '%s', must be '%s' or '%s'", override.Action, OVERRIDE_PIN, OVERRIDE_EXCLUDE)
+	}
+	if strings.TrimSpace(override.Vlans) == "" {
+		return fmt.Errorf("no VLANs given")
+	}
+	for _, part := range strings.Split(override.Vlans, ",") {
+		if _, err := parseVlanRange(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describe summarizes the override for logging
+func (override *Override) describe() string {
+	text := fmt.Sprintf("VLAN %s pinned", override.Vlans)
+	if override.Action == OVERRIDE_EXCLUDE {
+		text = fmt.Sprintf("VLAN %s excluded", override.Vlans)
+	}
+	if override.Reason != "" {
+		text += " : " + override.Reason
+	}
+	if override.Expires != nil {
+		text += fmt.Sprintf(" (until %s)", override.Expires.Format(time.RFC3339))
+	}
+	return text
+}
+
+// loadOverrides reads the overrides from a file, a file that does not exist
+// has no overrides
+func loadOverrides(path string) ([]Override, error) {
+	data, err := readFile(path)
+	if os.IsNotExist(err) {
+		return []Override{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var doc struct {
+		Overrides []Override `json:"overrides"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc.Overrides, nil
+}
+
+// saveOverrides writes the overrides to a file, dropping any that have
+// expired
+func saveOverrides(path string, overrides []Override) error {
+	now := time.Now()
+	current := []Override{}
+	for _, override := range overrides {
+		if !override.expired(now) {
+			current = append(current, override)
+		}
+	}
+	data, err := json.MarshalIndent(map[string]interface{}{"overrides": current}, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// addOverride adds an override to the file, replacing any existing override
+// of the same VLANs
+func (app *Application) addOverride(override Override) error {
+	if err := override.validate(); err != nil {
+		return err
+	}
+	app.overridesLock.Lock()
+	defer app.overridesLock.Unlock()
+	overrides, err := loadOverrides(app.OverridesFile)
+	if err != nil {
+		return err
+	}
+	result := []Override{}
+	for _, existing := range overrides {
+		if existing.Vlans != override.Vlans {
+			result = append(result, existing)
+		}
+	}
+	return saveOverrides(app.OverridesFile, append(result, override))
+}
+
+// removeOverride removes the override of the given VLANs from the file
+func (app *Application) removeOverride(vlans string) (bool, error) {
+	app.overridesLock.Lock()
+	defer app.overridesLock.Unlock()
+	overrides, err := loadOverrides(app.OverridesFile)
+	if err != nil {
+		return false, err
+	}
+	result := []Override{}
+	for _, existing := range overrides {
+		if existing.Vlans != vlans {
+			result = append(result, existing)
+		}
+	}
+	if len(result) == len(overrides) {
+		return false, nil
+	}
+	return true, saveOverrides(app.OverridesFile, result)
+}
+
+/*
+ * applyOverrides returns the required VLANs with the operator overrides
+ * applied on top: pinned VLANs are required even if no source requires them
+ * and excluded VLANs are never required, exclusion taking precedence. The
+ * overrides are re-read every synchronization, so that changes made with the
+ * CLI take effect. Should the file be unreadable the previous overrides
+ * continue to apply. The given map is not modified.
+ */
+func (app *Application) applyOverrides(owners map[string]string) map[string]string {
+	result := make(map[string]string, len(owners))
+	for vlan, owner := range owners {
+		result[vlan] = owner
+	}
+	if app.OverridesFile == "" {
+		return result
+	}
+
+	app.overridesLock.Lock()
+	overrides, err := loadOverrides(app.OverridesFile)
+	app.overridesLock.Unlock()
+	if err != nil {
+		log.Errorf("Unable to read overrides from '%s', using previous overrides : %s", app.OverridesFile, err)
+		overrides = app.overrides
+	}
+	app.overrides = overrides
+
+	now := time.Now()
+	active := []Override{}
+	app.excluded = make(map[string]string)
+	for _, action := range []string{OVERRIDE_PIN, OVERRIDE_EXCLUDE} {
+		for _, override := range overrides {
+			if override.Action != action || override.expired(now) {
+				continue
+			}
+			active = append(active, override)
+			if app.observing() {
+				log.Infof("[OVERRIDE] %s", override.describe())
+			} else {
+				log.Debugf("[OVERRIDE] %s", override.describe())
+			}
+			for _, vlan := range expandVlans(override.Vlans, "override") {
+				if action == OVERRIDE_PIN {
+					if _, ok := result[vlan]; !ok {
+						result[vlan] = SOURCE_OVERRIDE
+					}
+				} else {
+					delete(result, vlan)
+					app.excluded[vlan] = override.describe()
+				}
+			}
+		}
+	}
+	app.updateStatus(func(status *Status) {
+		status.Overrides = active
+	})
+	return result
+}
+
+// parseExpiry parses the expiry of an override, either a time (RFC3339) or a
+// duration from now
+func parseExpiry(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		expires := time.Now().UTC().Add(d)
+		return &expires, nil
+	}
+	expires, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return &expires, nil
+}
+
+// overrideCommand implements the "letmein override" command, which lists,
+// adds and removes overrides
+func overrideCommand(app *Application, args []string) int {
+	var vlans, reason, expires string
+
+	flags := flag.NewFlagSet("override", flag.ExitOnError)
+	flags.StringVar(&vlans, "vlan", "", "VLAN ID, range or comma separated list to override")
+	flags.StringVar(&reason, "reason", "", "why the override is needed")
+	flags.StringVar(&expires, "expires", "", "when the override expires (RFC3339 or duration from now), empty for never")
+	flags.StringVar(&app.OverridesFile, "file", app.OverridesFile, "overrides file")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: letmein override list|pin|exclude|remove [options]")
+		flags.PrintDefaults()
+	}
+	if len(args) == 0 {
+		flags.Usage()
+		return 2
+	}
+	command := args[0]
+	flags.Parse(args[1:])
+
+	if app.OverridesFile == "" {
+		fmt.Fprintln(os.Stderr, "No overrides file configured, set OVERRIDES_FILE or use -file")
+		return 2
+	}
+
+	switch command {
+	case "list":
+		overrides, err := loadOverrides(app.OverridesFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read overrides from '%s' : %s\n", app.OverridesFile, err)
+			return 1
+		}
+		tabs := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+		fmt.Fprintln(tabs, "VLANS\tACTION\tEXPIRES\tREASON")
+		now := time.Now()
+		for _, override := range overrides {
+			expiry := "never"
+			if override.Expires != nil {
+				expiry = override.Expires.Format(time.RFC3339)
+				if override.expired(now) {
+					expiry += " (expired)"
+				}
+			}
+			fmt.Fprintf(tabs, "%s\t%s\t%s\t%s\n", override.Vlans, override.Action, expiry, override.Reason)
+		}
+		tabs.Flush()
+	case OVERRIDE_PIN, OVERRIDE_EXCLUDE:
+		expiry, err := parseExpiry(expires)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid value for -expires '%s' : %s\n", expires, err)
+			return 2
+		}
+		override := Override{
+			Vlans:   vlans,
+			Action:  command,
+			Reason:  reason,
+			Created: time.Now().UTC(),
+			Expires: expiry,
+		}
+		if err := app.addOverride(override); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to add override : %s\n", err)
+			return 1
+		}
+		fmt.Println(override.describe())
+	case "remove":
+		found, err := app.removeOverride(vlans)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to remove override : %s\n", err)
+			return 1
+		}
+		if !found {
+			fmt.Fprintf(os.Stderr, "No override of VLAN %s\n", vlans)
+			return 1
+		}
+	default:
+		flags.Usage()
+		return 2
+	}
+	return 0
+}
+
+// handleOverrides lists (GET), adds (POST) and removes (DELETE ?vlan=) the
+// overrides through the admin API
+func (app *Application) handleOverrides(w http.ResponseWriter, r *http.Request) {
+	if !app.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if app.OverridesFile == "" {
+		http.Error(w, "no overrides file configured", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var override Override
+		if err := json.NewDecoder(r.Body).Decode(&override); err != nil {
+			http.Error(w, fmt.Sprintf("invalid override : %s", err), http.StatusBadRequest)
+			return
+		}
+		override.Created = time.Now().UTC()
+		if err := override.validate(); err != nil {
+			http.Error(w, fmt.Sprintf("invalid override : %s", err), http.StatusBadRequest)
+			return
+		}
+		if err := app.addOverride(override); err != nil {
+			http.Error(w, fmt.Sprintf("unable to add override : %s", err), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("Override added by %s : %s", r.RemoteAddr, override.describe())
+	case http.MethodDelete:
+		vlans := r.URL.Query().Get("vlan")
+		found, err := app.removeOverride(vlans)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("unable to remove override : %s", err), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, fmt.Sprintf("no override of VLAN %s", vlans), http.StatusNotFound)
+			return
+		}
+		log.Infof("Override of VLAN %s removed by %s", vlans, r.RemoteAddr)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	app.overridesLock.Lock()
+	overrides, err := loadOverrides(app.OverridesFile)
+	app.overridesLock.Unlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to read overrides : %s", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	encoder.Encode(map[string]interface{}{"overrides": overrides})
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestValidateOverride(t *testing.T) {
+	for _, test := range []struct {
+		override Override
+		valid    bool
+	}{
+		{Override{Vlans: "100", Action: OVERRIDE_PIN}, true},
+		{Override{Vlans: "100-200,300", Action: OVERRIDE_EXCLUDE}, true},
+		{Override{Vlans: "100", Action: "allow"}, false},
+		{Override{Vlans: " ", Action: OVERRIDE_PIN}, false},
+		{Override{Vlans: "100,abc", Action: OVERRIDE_PIN}, false},
+		{Override{Vlans: "4095", Action: OVERRIDE_EXCLUDE}, false},
+	} {
+		if err := test.override.validate(); (err == nil) != test.valid {
+			t.Errorf("Override %+v returned error %v, expected valid %t", test.override, err, test.valid)
+		}
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	for _, test := range []struct {
+		value   string
+		expires bool
+		valid   bool
+	}{
+		{"", false, true},
+		{"1h", true, true},
+		{"2030-01-02T03:04:05Z", true, true},
+		{"tomorrow", false, false},
+	} {
+		expires, err := parseExpiry(test.value)
+		if (err == nil) != test.valid || (expires != nil) != test.expires {
+			t.Errorf("'%s' parsed to %v, error %v, expected expiry %t, valid %t", test.value, expires, err, test.expires, test.valid)
+		}
+	}
+}
+
+func TestApplyOverrides(t *testing.T) {
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+	for _, test := range []struct {
+		name      string
+		owners    map[string]string
+		overrides []Override
+		result    map[string]string
+		excluded  []string
+	}{
+		{"none", map[string]string{"100": "netcfg:a"}, nil,
+			map[string]string{"100": "netcfg:a"}, []string{}},
+		{"pin", map[string]string{"100": "netcfg:a"},
+			[]Override{{Vlans: "100-101", Action: OVERRIDE_PIN}},
+			map[string]string{"100": "netcfg:a", "101": SOURCE_OVERRIDE}, []string{}},
+		{"exclude", map[string]string{"100": "netcfg:a", "101": "netcfg:b"},
+			[]Override{{Vlans: "101,200", Action: OVERRIDE_EXCLUDE}},
+			map[string]string{"100": "netcfg:a"}, []string{"101", "200"}},
+		{"exclude wins over pin", nil,
+			[]Override{{Vlans: "100", Action: OVERRIDE_EXCLUDE}, {Vlans: "100-101", Action: OVERRIDE_PIN}},
+			map[string]string{"101": SOURCE_OVERRIDE}, []string{"100"}},
+		{"expired ignored", map[string]string{"100": "netcfg:a"},
+			[]Override{{Vlans: "100", Action: OVERRIDE_EXCLUDE, Expires: &past}, {Vlans: "200", Action: OVERRIDE_PIN, Expires: &future}},
+			map[string]string{"100": "netcfg:a", "200": SOURCE_OVERRIDE}, []string{}},
+	} {
+		dir, err := ioutil.TempDir("", "letmein")
+		if err != nil {
+			t.Fatal(err)
+		}
+		app := newApplication()
+		app.OverridesFile = filepath.Join(dir, "overrides.json")
+		if test.overrides != nil {
+			if err := saveOverrides(app.OverridesFile, test.overrides); err != nil {
+				t.Fatal(err)
+			}
+		}
+		owners := make(map[string]string)
+		for vlan, owner := range test.owners {
+			owners[vlan] = owner
+		}
+
+		result := app.applyOverrides(owners)
+		os.RemoveAll(dir)
+		if !reflect.DeepEqual(result, test.result) {
+			t.Errorf("%s: resulted in %v, expected %v", test.name, result, test.result)
+		}
+		if len(owners) != len(test.owners) {
+			t.Errorf("%s: modified the required VLANs to %v", test.name, owners)
+		}
+		excluded := []string{}
+		for vlan := range app.excluded {
+			excluded = append(excluded, vlan)
+		}
+		sort.Strings(excluded)
+		if !reflect.DeepEqual(excluded, test.excluded) {
+			t.Errorf("%s: excluded %v, expected %v", test.name, excluded, test.excluded)
+		}
+	}
+}
+
+// TestOverridesFile checks that overrides are added, replaced and removed in
+// the file, and that the last overrides read continue to apply should the
+// file become unreadable
+func TestOverridesFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letmein")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	app := newApplication()
+	app.OverridesFile = filepath.Join(dir, "overrides.json")
+
+	if overrides, err := loadOverrides(app.OverridesFile); err != nil || len(overrides) != 0 {
+		t.Errorf("Missing file returned %v, error %v, expected no overrides", overrides, err)
+	}
+	if err := app.addOverride(Override{Vlans: "100", Action: "allow"}); err == nil {
+		t.Errorf("Invalid override was added")
+	}
+	past := time.Now().Add(-time.Hour)
+	for _, override := range []Override{
+		{Vlans: "100", Action: OVERRIDE_PIN, Reason: "first"},
+		{Vlans: "200", Action: OVERRIDE_EXCLUDE, Expires: &past},
+		{Vlans: "300", Action: OVERRIDE_EXCLUDE},
+		{Vlans: "100", Action: OVERRIDE_EXCLUDE, Reason: "second"},
+	} {
+		if err := app.addOverride(override); err != nil {
+			t.Fatalf("Unable to add override %+v : %s", override, err)
+		}
+	}
+	overrides, err := loadOverrides(app.OverridesFile)
+	if err != nil {
+		t.Fatalf("Unable to load overrides : %s", err)
+	}
+	described := []string{}
+	for _, override := range overrides {
+		described = append(described, override.describe())
+	}
+	expected := []string{"VLAN 300 excluded", "VLAN 100 excluded : second"}
+	if !reflect.DeepEqual(described, expected) {
+		t.Errorf("Saved overrides %v, expected %v", described, expected)
+	}
+
+	if found, err := app.removeOverride("300"); !found || err != nil {
+		t.Errorf("Removing override returned %t, error %v", found, err)
+	}
+	if found, err := app.removeOverride("300"); found || err != nil {
+		t.Errorf("Removing removed override returned %t, error %v", found, err)
+	}
+
+	if result := app.applyOverrides(map[string]string{"100": "netcfg:a"}); len(result) != 0 {
+		t.Errorf("Overrides resulted in %v, expected none", result)
+	}
+	ioutil.WriteFile(app.OverridesFile, []byte("{"), 0644)
+	if result := app.applyOverrides(map[string]string{"100": "netcfg:a"}); len(result) != 0 {
+		t.Errorf("Unreadable overrides resulted in %v, expected previous overrides to apply", result)
+	}
+	if _, err := app.removeOverride("100"); err == nil {
+		t.Errorf("Removing override from unreadable file did not return an error")
+	}
+	data, _ := json.Marshal(app.currentStatus().Overrides)
+	if string(data) == "null" || string(data) == "[]" {
+		t.Errorf("Status reports no active overrides")
+	}
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/Jeffail/gabs"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	PROGRAM_FLOWS      = "flows"
+	PROGRAM_OBJECTIVES = "objectives"
+	PROGRAM_INTENTS    = "intents"
+
+	OBJECTIVE_URL     = "%s/onos/v1/flowobjectives/%s/forward"
+	INTENTS_URL       = "%s/onos/v1/intents"
+	DELETE_INTENT_URL = "%s/onos/v1/intents/%s/%s"
+
+	OBJECTIVE_ADD    = "ADD"
+	OBJECTIVE_REMOVE = "REMOVE"
+	INTENT_INSTALLED = "INSTALLED"
+	INTENT_FAILED    = "FAILED"
+	INTENT_WITHDRAWN = "WITHDRAWN"
+)
+
+/*
+ * objectiveBody converts a flow rule, either rendered from a template or read
+ * from ONOS, to a forwarding objective that adds or removes it. ONOS passes the
+ * objective to the pipeline driver of the switch, which programs the rules the
+ * switch's pipeline needs, so only the selector, treatment and priority of the
+ * rule are carried over.
+ */
+func objectiveBody(rule []byte, operation string) ([]byte, error) {
+	flow, err := gabs.ParseJSON(rule)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse flow rule : %s", err)
+	}
+	objective := map[string]interface{}{
+		"appId":       APP_ID,
+		"priority":    flow.Path("priority").Data(),
+		"isPermanent": true,
+		"timeout":     0,
+		"flag":        "VERSATILE",
+		"operation":   operation,
+		"selector": map[string]interface{}{
+			"criteria": flow.Path("selector.criteria").Data(),
+		},
+		"treatment": map[string]interface{}{
+			"instructions": flow.Path("treatment.instructions").Data(),
+		},
+	}
+	return json.Marshal(objective)
+}
+
+// Objective is a forwarding objective issued by letmein, recorded by the
+// selector of the rule from which it was made
+type Objective struct {
+	Vlan string          `json:"vlan"`
+	Port string          `json:"port"`
+	Rule json.RawMessage `json:"rule"`
+}
+
+/*
+ * objectiveChanges determines the changes needed to bring the objectives
+ * issued by letmein in line with the desired rules. The flows that the
+ * pipeline driver programs for an objective may be in other tables and have
+ * other criteria than the rule, so the objectives are reconciled against the
+ * record of those issued rather than the flows on the switch. An obsolete
+ * objective is removed with the same rule from which it was added.
+ */
+func (app *Application) objectiveChanges(dpid string, owners map[string]string, desired []*DesiredFlow, need map[string]*DesiredFlow) []*FlowChange {
+	codec := app.codec()
+	changes := []*FlowChange{}
+	have := make(map[string]bool)
+	replace := make(map[string]string)
+	for selector, objective := range app.objectives {
+		reason := "VLAN no longer required by network configuration"
+		if want, ok := need[selector]; ok {
+			rule, err := gabs.ParseJSON(objective.Rule)
+			if err == nil && flowTreatment(codec, rule) == flowTreatment(codec, want.Flow) {
+				have[selector] = true
+				continue
+			}
+
+			// As with flows, adding the objective for the changed rule
+			// replaces the existing one unless the priority has changed
+			reason = fmt.Sprintf("%s rule for VLAN %s changed", want.Direction, want.Vlan)
+			if err == nil && canonical(rule.Path("priority").Data()) == canonical(want.Flow.Path("priority").Data()) {
+				log.Infof("[REPLACE]: VLAN %s objective : %s", objective.Vlan, reason)
+				replace[selector] = reason
+				continue
+			}
+		} else if _, required := owners[objective.Vlan]; required {
+			reason = fmt.Sprintf("rule for VLAN %s no longer matches required traffic", objective.Vlan)
+		} else if override, excluded := app.excluded[objective.Vlan]; excluded {
+			reason = "override: " + override
+		}
+		log.Infof("[DELETE]: VLAN %s objective : %s", objective.Vlan, reason)
+		changes = append(changes, &FlowChange{
+			Action:   AUDIT_DELETE,
+			Switch:   dpid,
+			Port:     objective.Port,
+			Vlan:     objective.Vlan,
+			Flow:     objective.Rule,
+			Reason:   reason,
+			Selector: selector,
+		})
+	}
+
+	for _, flow := range desired {
+		selector := flowSelector(codec, flow.Flow)
+		if need[selector] != flow {
+			continue
+		}
+		if have[selector] {
+			log.Debugf("[EXISTS] VLAN %s %s objective", flow.Vlan, flow.Direction)
+			continue
+		}
+		reason, ok := replace[selector]
+		if !ok {
+			reason = "VLAN required by network configuration"
+		}
+		log.Infof("[CREATE] VLAN %s %s objective", flow.Vlan, flow.Direction)
+		changes = append(changes, &FlowChange{
+			Action:   AUDIT_CREATE,
+			Switch:   dpid,
+			Port:     flow.Port,
+			Vlan:     flow.Vlan,
+			Flow:     flow.Body,
+			Reason:   reason,
+			Source:   flow.Source,
+			Selector: selector,
+		})
+	}
+	return changes
+}
+
+/*
+ * recordObjectives updates the record of the objectives issued with the
+ * changes that were made, and persists it with the snapshot. A removal only
+ * clears the record if it was of the objective recorded, as the objective
+ * that replaces it may already have been added.
+ */
+func (app *Application) recordObjectives(changes []*FlowChange) {
+	objectives := make(map[string]*Objective, len(app.objectives))
+	for selector, objective := range app.objectives {
+		objectives[selector] = objective
+	}
+	updated := false
+	for _, change := range changes {
+		if !change.Applied {
+			continue
+		}
+		switch change.Action {
+		case AUDIT_CREATE:
+			objectives[change.Selector] = &Objective{Vlan: change.Vlan, Port: change.Port, Rule: change.Flow}
+			updated = true
+		case AUDIT_DELETE:
+			if objective, ok := objectives[change.Selector]; ok && bytes.Equal(objective.Rule, change.Flow) {
+				delete(objectives, change.Selector)
+				updated = true
+			}
+		}
+	}
+	if !updated {
+		return
+	}
+	app.objectives = objectives
+	if app.snapshot != nil {
+		snapshot := *app.snapshot
+		app.snapshot = &snapshot
+		app.persistSnapshot()
+	}
+}
+
+/*
+ * intentBody converts a flow rule rendered from a template to a point to point
+ * intent. The IN_PORT criterion of the rule becomes the ingress point of the
+ * intent and its OUTPUT instruction the egress point, so only rules that
+ * forward between two ports, i.e. those of forward mode, can be expressed as
+ * intents. The key of the intent is derived from its content, so that a change
+ * to the rule results in a new intent.
+ */
+func intentBody(dpid string, flow *DesiredFlow) (string, []byte, error) {
+	ingress, egress := "", ""
+	criteria := []interface{}{}
+	children, _ := flow.Flow.Path("selector.criteria").Children()
+	for _, criterion := range children {
+		if criterion.Path("type").Data() == "IN_PORT" {
+			ingress = canonical(criterion.Path("port").Data())
+			continue
+		}
+		criteria = append(criteria, criterion.Data())
+	}
+	instructions := []interface{}{}
+	children, _ = flow.Flow.Path("treatment.instructions").Children()
+	for _, instruction := range children {
+		if instruction.Path("type").Data() == "OUTPUT" {
+			egress = canonical(instruction.Path("port").Data())
+			continue
+		}
+		instructions = append(instructions, instruction.Data())
+	}
+	if ingress == "" || egress == "" || egress == "CONTROLLER" {
+		return "", nil, fmt.Errorf("%s rule for VLAN %s does not forward between two ports and cannot be programmed as an intent",
+			flow.Direction, flow.Vlan)
+	}
+
+	intent := map[string]interface{}{
+		"type":     "PointToPointIntent",
+		"appId":    APP_ID,
+		"priority": flow.Flow.Path("priority").Data(),
+		"selector": map[string]interface{}{
+			"criteria": criteria,
+		},
+		"treatment": map[string]interface{}{
+			"instructions": instructions,
+		},
+		"ingressPoint": map[string]interface{}{
+			"device": dpid,
+			"port":   ingress,
+		},
+		"egressPoint": map[string]interface{}{
+			"device": dpid,
+			"port":   egress,
+		},
+	}
+	wrapper, err := gabs.Consume(intent)
+	if err != nil {
+		return "", nil, err
+	}
+	sum := sha1.Sum([]byte(canonical(wrapper.Data())))
+	key := fmt.Sprintf("letmein-%s-%s-%s", flow.Vlan, flow.Direction, hex.EncodeToString(sum[:4]))
+	wrapper.Set(key, "key")
+	return key, wrapper.Bytes(), nil
+}
+
+// intentVlan returns the VLAN of an intent from its key
+func intentVlan(key string) string {
+	parts := strings.Split(key, "-")
+	if len(parts) != 4 {
+		return ""
+	}
+	return parts[1]
+}
+
+// managedIntents returns the intents that were submitted by letmein, by key
+func (app *Application) managedIntents() (map[string]*gabs.Container, error) {
+	wrapper, err := app.fetchJSON(fmt.Sprintf(INTENTS_URL, app.OnosConnectUrl))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query ONOS intents : %s", err)
+	}
+	intents := make(map[string]*gabs.Container)
+	children, _ := wrapper.Path("intents").Children()
+	for _, intent := range children {
+		if appId, _ := intent.Path(KEY_APP_ID).Data().(string); appId != APP_ID {
+			continue
+		}
+		if key, ok := intent.Path("key").Data().(string); ok {
+			intents[key] = intent
+		}
+	}
+	return intents, nil
+}
+
+/*
+ * intentChanges determines the changes needed to bring the intents submitted
+ * by letmein in line with the desired rules. As intent keys are derived from
+ * their content an intent is either exactly as required or obsolete. Intents
+ * that ONOS failed to install are resubmitted.
+ */
+func (app *Application) intentChanges(dpid string, desired []*DesiredFlow, need map[string]*DesiredFlow) ([]*FlowChange, int, error) {
+	intents, err := app.managedIntents()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	codec := app.codec()
+	changes := []*FlowChange{}
+	failed := 0
+	wanted := make(map[string]bool)
+	for _, flow := range desired {
+		if need[flowSelector(codec, flow.Flow)] != flow {
+			continue
+		}
+		key, body, err := intentBody(dpid, flow)
+		if err != nil {
+			log.Error(err)
+			metrics.Inc("letmein_flow_change_errors_total")
+			failed++
+			continue
+		}
+		wanted[key] = true
+		reason := "VLAN required by network configuration"
+		if intent, ok := intents[key]; ok {
+			state, _ := intent.Path("state").Data().(string)
+			if state != INTENT_FAILED && state != INTENT_WITHDRAWN {
+				log.Debugf("[EXISTS] VLAN %s %s intent %s", flow.Vlan, flow.Direction, key)
+				continue
+			}
+			reason = fmt.Sprintf("%s intent for VLAN %s is %s", flow.Direction, flow.Vlan, state)
+		}
+		log.Infof("[CREATE] VLAN %s %s intent %s", flow.Vlan, flow.Direction, key)
+		changes = append(changes, &FlowChange{
+			Action: AUDIT_CREATE,
+			Switch: dpid,
+			Port:   flow.Port,
+			Vlan:   flow.Vlan,
+			FlowId: key,
+			Flow:   body,
+			Reason: reason,
+			Source: flow.Source,
+		})
+	}
+
+	for key, intent := range intents {
+		if wanted[key] {
+			continue
+		}
+		log.Infof("[DELETE]: intent %s : no longer required", key)
+		changes = append(changes, &FlowChange{
+			Action: AUDIT_DELETE,
+			Switch: dpid,
+			Vlan:   intentVlan(key),
+			FlowId: key,
+			Flow:   intent.Bytes(),
+			Reason: "intent no longer matches required traffic",
+		})
+	}
+	return changes, failed, nil
+}
+
+// changeRequest creates the request to ONOS that makes a change, according
+// to how rules are programmed
+func (app *Application) changeRequest(change *FlowChange) (*http.Request, error) {
+	var req *http.Request
+	var err error
+	switch {
+	case app.Programming == PROGRAM_INTENTS && change.Action == AUDIT_CREATE:
+		req, err = http.NewRequest(http.MethodPost,
+			fmt.Sprintf(INTENTS_URL, app.OnosConnectUrl), bytes.NewReader(change.Flow))
+	case app.Programming == PROGRAM_INTENTS && change.Action == AUDIT_DELETE:
+		req, err = http.NewRequest(http.MethodDelete,
+			fmt.Sprintf(DELETE_INTENT_URL, app.OnosConnectUrl, APP_ID, url.PathEscape(change.FlowId)), nil)
+	case app.Programming == PROGRAM_OBJECTIVES && (change.Action == AUDIT_CREATE || change.Action == AUDIT_DELETE):
+		operation := OBJECTIVE_ADD
+		if change.Action == AUDIT_DELETE {
+			operation = OBJECTIVE_REMOVE
+		}
+		var body []byte
+		body, err = objectiveBody(change.Flow, operation)
+		if err == nil {
+			req, err = http.NewRequest(http.MethodPost,
+				fmt.Sprintf(OBJECTIVE_URL, app.OnosConnectUrl, change.Switch), bytes.NewReader(body))
+		}
+	case change.Action == AUDIT_CREATE:
+		req, err = http.NewRequest(http.MethodPost,
+			fmt.Sprintf(FLOWS_URL, app.OnosConnectUrl, change.Switch), bytes.NewReader(change.Flow))
+	case change.Action == AUDIT_DELETE:
+		req, err = http.NewRequest(http.MethodDelete,
+			fmt.Sprintf(DELETE_FLOW_URL, app.OnosConnectUrl, change.Switch, change.FlowId), nil)
+	default:
+		return nil, fmt.Errorf("Unknown flow change action '%s'", change.Action)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if req.Method == http.MethodPost {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
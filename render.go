@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/Jeffail/gabs"
+	"io/ioutil"
+	"os"
+)
+
+/*
+ * renderCommand implements the "letmein render" command, which renders the
+ * flow rules that letmein would create for a network configuration read from
+ * a file, without contacting ONOS, so that template changes can be reviewed
+ * before they are rolled out. The rules are output as a flows array that can
+ * be POSTed to the ONOS bulk flows API. The remaining configuration, e.g. the
+ * mode and tables, is taken from the environment as usual.
+ */
+func renderCommand(app *Application, args []string) int {
+	var netcfgFile, dpid, inPort, outPort, output string
+
+	flags := flag.NewFlagSet("render", flag.ExitOnError)
+	flags.StringVar(&netcfgFile, "netcfg", "", "file containing the ONOS network configuration")
+	flags.StringVar(&dpid, "dpid", "", "DPID of the switch")
+	flags.StringVar(&inPort, "in-port", "", "port on the switch on which the VLANs' traffic arrives")
+	flags.StringVar(&outPort, "out-port", "", "port out of which traffic is forwarded, in forward mode")
+	flags.StringVar(&output, "o", "-", "file to which the flows are written, - for stdout")
+	flags.StringVar(&app.Mode, "mode", app.Mode, "mode, punt or forward")
+	flags.StringVar(&app.CreateFlowTemplate, "template", app.CreateFlowTemplate, "template of the rule in punt mode")
+	flags.StringVar(&app.ForwardFlowTemplate, "forward-template", app.ForwardFlowTemplate, "template of the forwarding rule in forward mode")
+	flags.StringVar(&app.ReverseFlowTemplate, "reverse-template", app.ReverseFlowTemplate, "template of the reverse rule in forward mode")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: letmein render -netcfg <file> -dpid <dpid> -in-port <port> [options]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if netcfgFile == "" || dpid == "" || inPort == "" {
+		flags.Usage()
+		return 2
+	}
+	if app.Mode == MODE_FORWARD && outPort == "" {
+		fmt.Fprintln(os.Stderr, "An output port must be given with -out-port in forward mode")
+		return 2
+	}
+
+	// Nothing that would contact ONOS, or any other service, is used
+	app.DesiredSources = []string{NETCFG}
+	app.SadisUrl = ""
+	if err := app.configure(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if app.MeterMode != "" {
+		fmt.Fprintln(os.Stderr, "Meters are created by ONOS, so rules are rendered without them")
+	}
+
+	data, err := ioutil.ReadFile(netcfgFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read network configuration '%s' : %s\n", netcfgFile, err)
+		return 1
+	}
+	netcfg, err := gabs.ParseJSON(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to parse network configuration '%s' : %s\n", netcfgFile, err)
+		return 1
+	}
+	owners := app.applyStaticVlans(app.netcfgVlans(netcfg))
+	ports := make(map[string]string, len(owners))
+	for vlan := range owners {
+		ports[vlan] = inPort
+	}
+
+	desired, failed, err := app.desiredFlows(dpid, outPort, owners, ports, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "Unable to render %d rules\n", failed)
+		return 1
+	}
+
+	flows := make([]interface{}, 0, len(desired))
+	for _, rule := range desired {
+		if !rule.Flow.Exists("deviceId") {
+			rule.Flow.Set(dpid, "deviceId")
+		}
+		flows = append(flows, rule.Flow.Data())
+	}
+	body, err := json.MarshalIndent(map[string]interface{}{"flows": flows}, "", "    ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to encode flows : %s\n", err)
+		return 1
+	}
+	body = append(body, '\n')
+
+	if output == "-" {
+		os.Stdout.Write(body)
+	} else if err := ioutil.WriteFile(output, body, 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to write flows to '%s' : %s\n", output, err)
+		return 1
+	}
+	return 0
+}
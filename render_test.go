@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// renderApplication returns an application configured, as by the defaults,
+// to render rules from the templates of the repository
+func renderApplication() *Application {
+	app := newApplication()
+	app.OnosConnectUrl = "http://localhost:8181"
+	app.OnosVersion = VERSION_DETECT
+	app.CreateFlowTemplate = "rule.tmpl"
+	app.ForwardFlowTemplate = "forward.tmpl"
+	app.ReverseFlowTemplate = "reverse.tmpl"
+	app.Mode = MODE_PUNT
+	app.Programming = PROGRAM_FLOWS
+	app.ConflictCheck = CONFLICT_OFF
+	app.DesiredCompose = COMPOSE_UNION
+	app.Workers = 1
+	return app
+}
+
+// TestRender checks that the rendered rules are output as a valid flows
+// document, with nothing else written to it
+func TestRender(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		netcfg string
+		args   []string
+		status int
+		flows  int
+	}{
+		{"punt", netcfgVlan("100-101"), []string{"-dpid", testSwitch, "-in-port", "3"}, 0, 2},
+		{"no VLANs", `{"devices":{}}`, []string{"-dpid", testSwitch, "-in-port", "3"}, 0, 0},
+		{"forward", netcfgVlan("100"), []string{"-dpid", testSwitch, "-in-port", "3", "-mode", MODE_FORWARD, "-out-port", "4"}, 0, 2},
+		{"forward without output port", netcfgVlan("100"), []string{"-dpid", testSwitch, "-in-port", "3", "-mode", MODE_FORWARD}, 2, 0},
+		{"no switch", netcfgVlan("100"), []string{"-in-port", "3"}, 2, 0},
+		{"missing template", netcfgVlan("100"), []string{"-dpid", testSwitch, "-in-port", "3", "-template", "missing.tmpl"}, 1, 0},
+		{"invalid network configuration", `{"devices":`, []string{"-dpid", testSwitch, "-in-port", "3"}, 1, 0},
+	} {
+		dir, err := ioutil.TempDir("", "letmein")
+		if err != nil {
+			t.Fatal(err)
+		}
+		netcfg, output := filepath.Join(dir, "netcfg.json"), filepath.Join(dir, "flows.json")
+		ioutil.WriteFile(netcfg, []byte(test.netcfg), 0644)
+
+		args := append([]string{"-netcfg", netcfg, "-o", output}, test.args...)
+		status := renderCommand(renderApplication(), args)
+		data, _ := ioutil.ReadFile(output)
+		os.RemoveAll(dir)
+		if status != test.status {
+			t.Errorf("%s: exited with %d, expected %d", test.name, status, test.status)
+			continue
+		}
+		if status != 0 {
+			continue
+		}
+
+		var doc struct {
+			Flows []map[string]interface{} `json:"flows"`
+		}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			t.Errorf("%s: output is not valid JSON : %s", test.name, err)
+			continue
+		}
+		if doc.Flows == nil || len(doc.Flows) != test.flows {
+			t.Errorf("%s: rendered %d flows, expected %d", test.name, len(doc.Flows), test.flows)
+		}
+		for _, flow := range doc.Flows {
+			if flow["deviceId"] != testSwitch || flow[KEY_APP_ID] != APP_ID {
+				t.Errorf("%s: rendered flow for %v of %v", test.name, flow["deviceId"], flow[KEY_APP_ID])
+			}
+		}
+	}
+
+	// Rendered to stdout, so that it can be piped to the ONOS bulk flows API
+	dir, err := ioutil.TempDir("", "letmein")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	netcfg := filepath.Join(dir, "netcfg.json")
+	ioutil.WriteFile(netcfg, []byte(netcfgVlan("100")), 0644)
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	status := renderCommand(renderApplication(), []string{"-netcfg", netcfg, "-dpid", testSwitch, "-in-port", "3"})
+	os.Stdout = stdout
+	writer.Close()
+	data, _ := ioutil.ReadAll(reader)
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); status != 0 || err != nil {
+		t.Errorf("Rendering to stdout exited with %d, output is not valid JSON : %v", status, err)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/Jeffail/gabs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const (
+	MODE_PUNT    = "punt"
+	MODE_FORWARD = "forward"
+
+	UPSTREAM   = "upstream"
+	DOWNSTREAM = "downstream"
+
+	VLAN_POP  = "pop"
+	VLAN_PUSH = "push"
+	VLAN_SET  = "set"
+
+	MAX_TABLE = 254
+)
+
+// RuleData is passed to the templates from which flow rules are rendered
+type RuleData struct {
+	AppId        string
+	DPID         string
+	VlanId       string
+	InPort       string
+	OutPort      string
+	VlanAction   string
+	ActionVlanId string
+	EgressVlanId string
+	TableId      string
+	GotoTableId  string
+	MeterId      string
+}
+
+// DesiredFlow is a flow rule, rendered from a template, that should exist on
+// the switch
+type DesiredFlow struct {
+	Vlan      string
+	Port      string
+	Direction string
+	Source    string
+	Body      []byte
+	Flow      *gabs.Container
+}
+
+// canonical renders a JSON value as a string that is independent of key
+// order and of whether numbers are represented as numbers or strings, as
+// ONOS returns numbers for values that templates typically render as strings
+func canonical(value interface{}) string {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		parts := make([]string, 0, len(keys))
+		for _, key := range keys {
+			parts = append(parts, key+"="+canonical(v[key]))
+		}
+		return "{" + strings.Join(parts, ",") + "}"
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			parts = append(parts, canonical(item))
+		}
+		return "[" + strings.Join(parts, ",") + "]"
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		if number, err := strconv.ParseFloat(v, 64); err == nil {
+			return strconv.FormatFloat(number, 'f', -1, 64)
+		}
+		return v
+	case nil:
+		return ""
+	}
+	return fmt.Sprintf("%v", value)
+}
+
+// flowSelector returns a canonical description of what a flow matches, and
+// in which table, which identifies the same rule whether rendered from a
+// template or read from ONOS, the criteria being decoded by the codec for the
+// version of ONOS. The order of the criteria is not significant.
+func flowSelector(codec Codec, flow *gabs.Container) string {
+	criteria, _ := flow.Path("selector.criteria").Children()
+	parts := make([]string, 0, len(criteria))
+	for _, criterion := range criteria {
+		parts = append(parts, canonical(codec.FlowItem(criterion)))
+	}
+	sort.Strings(parts)
+	return fmt.Sprintf("table=%s,%s", flowTable(flow), strings.Join(parts, ","))
+}
+
+// flowTable returns the table of a flow, flows without a table are in the
+// default table 0
+func flowTable(flow *gabs.Container) string {
+	if table := canonical(flow.Path("tableId").Data()); table != "" {
+		return table
+	}
+	return "0"
+}
+
+// flowInstructions returns the instructions of a flow in canonical form,
+// decoded by the codec for the version of ONOS
+func flowInstructions(codec Codec, flow *gabs.Container) string {
+	instructions, _ := flow.Path("treatment.instructions").Children()
+	parts := make([]string, 0, len(instructions))
+	for _, instruction := range instructions {
+		parts = append(parts, canonical(codec.FlowItem(instruction)))
+	}
+	return "[" + strings.Join(parts, ",") + "]"
+}
+
+// flowTreatment returns a canonical description of what a flow does with the
+// traffic it matches, including its priority
+func flowTreatment(codec Codec, flow *gabs.Container) string {
+	return fmt.Sprintf("priority=%s,%s", canonical(flow.Path("priority").Data()), flowInstructions(codec, flow))
+}
+
+// flowState returns the state of a flow as reported by ONOS
+func flowState(flow *gabs.Container) string {
+	state, _ := flow.Path("state").Data().(string)
+	return state
+}
+
+// parseVlanAction parses the FORWARD_VLAN_ACTION configuration, i.e. "",
+// "pop", "push:<vid>" or "set:<vid>"
+func parseVlanAction(value string) (string, string, error) {
+	parts := strings.SplitN(value, ":", 2)
+	switch parts[0] {
+	case "", "none":
+		return "", "", nil
+	case VLAN_POP:
+		return VLAN_POP, "", nil
+	case VLAN_PUSH, VLAN_SET:
+		if len(parts) != 2 {
+			return "", "", fmt.Errorf("VLAN action '%s' requires a VLAN ID, e.g. %s:100", parts[0], parts[0])
+		}
+		if _, err := parseVlanRange(parts[1]); err != nil || strings.Contains(parts[1], "-") {
+			return "", "", fmt.Errorf("invalid VLAN ID '%s' for VLAN action '%s'", parts[1], parts[0])
+		}
+		return parts[0], parts[1], nil
+	}
+	return "", "", fmt.Errorf("unknown VLAN action '%s'", value)
+}
+
+/*
+ * singleVlanAction checks that a VLAN action is only used when a single VLAN
+ * is managed. Once a VLAN has been popped, pushed under the same outer VLAN or
+ * set to the same VLAN, the downstream traffic of different VLANs cannot be
+ * told apart, so their reverse rules would all match the same traffic and
+ * only one of them could be installed.
+ */
+func singleVlanAction(action string, vlans int) error {
+	if action != "" && vlans > 1 {
+		return fmt.Errorf("The forward VLAN action '%s' can only be used when a single VLAN is managed, as the reverse rules of %d VLANs would match the same traffic",
+			action, vlans)
+	}
+	return nil
+}
+
+// loadTemplate parses a flow rule template file
+func loadTemplate(file string) (*template.Template, error) {
+	data, err := readFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read rule creation template '%s' : %s", file, err)
+	}
+	rule := template.New(path.Base(file))
+	if _, err := rule.Parse(string(data)); err != nil {
+		return nil, fmt.Errorf("Unable to parse rule creation template '%s' : %s", file, err)
+	}
+	return rule, nil
+}
+
+// renderFlow executes a template and parses the resulting flow rule. A rule
+// that does not specify its table is placed in the table configured for the
+// template.
+func renderFlow(rule *template.Template, data *RuleData) ([]byte, *gabs.Container, error) {
+	buf := bytes.NewBuffer(nil)
+	if err := rule.Execute(buf, data); err != nil {
+		return nil, nil, fmt.Errorf("Unable to execute create rule template : %s", err)
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &raw); err != nil {
+		return nil, nil, fmt.Errorf("Unable to parse rule rendered from template '%s' : %s", rule.Name(), err)
+	}
+	flow, err := gabs.Consume(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !flow.Exists("tableId") && data.TableId != "" {
+		table, _ := strconv.Atoi(data.TableId)
+		flow.Set(table, "tableId")
+		return flow.Bytes(), flow, nil
+	}
+	return buf.Bytes(), flow, nil
+}
+
+/*
+ * desiredFlows renders the flow rules that should exist on the switch for the
+ * required VLANs. In punt mode there is a single rule per VLAN that sends its
+ * traffic to ONOS. In forward mode there is a pair of rules per VLAN, one that
+ * forwards the traffic arriving from the OLT out of the output port, applying
+ * any VLAN action, and its reverse that returns traffic to the OLT.
+ */
+func (app *Application) desiredFlows(dpid, outPort string, owners, ports, meters map[string]string) ([]*DesiredFlow, int, error) {
+	templates := map[string]string{UPSTREAM: app.CreateFlowTemplate}
+	tables := map[string]int{UPSTREAM: app.CreateFlowTable}
+	if app.Mode == MODE_FORWARD {
+		templates = map[string]string{
+			UPSTREAM:   app.ForwardFlowTemplate,
+			DOWNSTREAM: app.ReverseFlowTemplate,
+		}
+		tables = map[string]int{
+			UPSTREAM:   app.ForwardFlowTable,
+			DOWNSTREAM: app.ReverseFlowTable,
+		}
+	}
+	rules := make(map[string]*template.Template)
+	for direction, file := range templates {
+		rule, err := loadTemplate(file)
+		if err != nil {
+			return nil, 0, err
+		}
+		rules[direction] = rule
+	}
+	action, actionVlan, err := parseVlanAction(app.ForwardVlanAction)
+	if err != nil {
+		return nil, 0, fmt.Errorf("Invalid forward VLAN action : %s", err)
+	}
+	if app.Mode == MODE_FORWARD {
+		if err := singleVlanAction(action, len(owners)); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	vlans := make([]string, 0, len(owners))
+	for vlan := range owners {
+		vlans = append(vlans, vlan)
+	}
+	sort.Strings(vlans)
+
+	desired := []*DesiredFlow{}
+	failed := 0
+	for _, vlan := range vlans {
+		data := &RuleData{
+			AppId:        APP_ID,
+			DPID:         dpid,
+			VlanId:       vlan,
+			InPort:       ports[vlan],
+			OutPort:      outPort,
+			VlanAction:   action,
+			ActionVlanId: actionVlan,
+			EgressVlanId: vlan,
+			GotoTableId:  app.GotoTable,
+			MeterId:      meters[vlan],
+		}
+		switch action {
+		case VLAN_POP:
+			data.EgressVlanId = ""
+		case VLAN_PUSH, VLAN_SET:
+			data.EgressVlanId = actionVlan
+		}
+		for _, direction := range []string{UPSTREAM, DOWNSTREAM} {
+			rule, ok := rules[direction]
+			if !ok {
+				continue
+			}
+			data.TableId = strconv.Itoa(tables[direction])
+			body, flow, err := renderFlow(rule, data)
+			if err != nil {
+				log.Errorf("Unable to render %s rule for VLAN %s : %s", direction, vlan, err)
+				metrics.Inc("letmein_flow_change_errors_total")
+				failed++
+				continue
+			}
+			desired = append(desired, &DesiredFlow{
+				Vlan:      vlan,
+				Port:      ports[vlan],
+				Direction: direction,
+				Source:    owners[vlan],
+				Body:      body,
+				Flow:      flow,
+			})
+		}
+	}
+	return desired, failed, nil
+}
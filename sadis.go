@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"github.com/Jeffail/gabs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	APPS      = "apps"
+	SADIS_APP = "org.opencord.sadis"
+	SADIS     = "sadis"
+	ENTRIES   = "entries"
+
+	SOURCE_NETCFG = "netcfg:"
+	SOURCE_SADIS  = "sadis:"
+)
+
+// addSource records that a VLAN is required by the given source, a VLAN
+// required by more than one source lists them all
+func addSource(owners map[string]string, vlan, source string) {
+	existing, ok := owners[vlan]
+	if !ok || existing == "" {
+		owners[vlan] = source
+		return
+	}
+	for _, have := range strings.Split(existing, ",") {
+		if have == source {
+			return
+		}
+	}
+	owners[vlan] = existing + "," + source
+}
+
+/*
+ * sadisVlans adds the S-TAG of each SADIS subscriber entry to the required
+ * VLANs. Subscriber entries carry either an "sTag" or, in more recent SADIS
+ * versions, a "uniTagList" with a "ponSTag" per UNI service. OLT entries,
+ * identified by their "uplinkPort", carry no subscriber VLANs and are skipped.
+ */
+func sadisVlans(entries []*gabs.Container, owners map[string]string) {
+	for _, entry := range entries {
+		id, _ := entry.Path("id").Data().(string)
+		if entry.Exists("uplinkPort") {
+			log.Debugf("Skipping SADIS OLT entry '%s'", id)
+			continue
+		}
+		source := SOURCE_SADIS + id
+		if entry.Exists("sTag") {
+			for _, vlan := range expandVlans(entry.Path("sTag").Data(), "SADIS subscriber "+id) {
+				addSource(owners, vlan, source)
+			}
+		}
+		services, _ := entry.Path("uniTagList").Children()
+		for _, service := range services {
+			if service.Exists("ponSTag") {
+				for _, vlan := range expandVlans(service.Path("ponSTag").Data(), "SADIS subscriber "+id) {
+					addSource(owners, vlan, source)
+				}
+			}
+		}
+	}
+}
+
+/*
+ * sadisSubscriberIds returns the IDs by which subscribers are looked up in
+ * SADIS, which are the names of the UNI ports of the OLTs. Any available
+ * device other than an Open vSwitch is taken to be an OLT.
+ */
+func (app *Application) sadisSubscriberIds() ([]string, error) {
+	wrapper, err := app.fetchJSON(fmt.Sprintf(DEVICES_URL, app.OnosConnectUrl))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query devices to look up SADIS subscribers : %s", err)
+	}
+	codec := app.codec()
+	ids := []string{}
+	devices, _ := wrapper.Path("devices").Children()
+	for _, child := range devices {
+		device := codec.Device(child)
+		if device.Hw == "Open vSwitch" || !device.Available {
+			continue
+		}
+		ports, err := app.fetchJSON(fmt.Sprintf(PORTS_URL, app.OnosConnectUrl, device.Id))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to query ports of OLT %s to look up SADIS subscribers : %s", device.Id, err)
+		}
+		children, _ := ports.Path("ports").Children()
+		for _, child := range children {
+			port := codec.Port(child)
+			if name, ok := port.Annotations["portName"]; ok && !port.Local {
+				ids = append(ids, name)
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+/*
+ * fetchSadisEntries reads SADIS entries from SADIS_URL. A URL containing "%s"
+ * is that of a SADIS server, e.g. http://sadis:8080/subscribers/%s, from which
+ * each subscriber is looked up by its ID, a subscriber that is not found being
+ * skipped. Any other URL is that of a bulk endpoint, which may return either
+ * an array of entries or an object with an "entries" array, as found in the
+ * SADIS network configuration.
+ */
+func (app *Application) fetchSadisEntries() ([]*gabs.Container, error) {
+	if strings.Contains(app.SadisUrl, "%s") {
+		ids, err := app.sadisSubscriberIds()
+		if err != nil {
+			return nil, err
+		}
+		entries := []*gabs.Container{}
+		for _, id := range ids {
+			entry, err := app.fetchJSON(fmt.Sprintf(app.SadisUrl, url.PathEscape(id)))
+			if status, ok := err.(*statusError); ok && status.code == http.StatusNotFound {
+				log.Debugf("No SADIS subscriber '%s'", id)
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("Unable to look up SADIS subscriber '%s' : %s", id, err)
+			}
+			entries = append(entries, entry)
+		}
+		return entries, nil
+	}
+
+	wrapper, err := app.fetchJSON(app.SadisUrl)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query SADIS entries from '%s' : %s", app.SadisUrl, err)
+	}
+	if wrapper.Exists(ENTRIES) {
+		wrapper = wrapper.Path(ENTRIES)
+	}
+	entries, err := wrapper.Children()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query list of SADIS entries : %s", err)
+	}
+	return entries, nil
+}
+
+/*
+ * sadisUrlVlans adds the VLANs of the SADIS entries read from SADIS_URL. So
+ * that SADIS being unavailable neither prevents the rest of the network
+ * configuration being used nor causes the rules of its subscribers to be
+ * deleted, the subscriber VLANs of the last known desired state are used
+ * instead should it fail.
+ */
+func (app *Application) sadisUrlVlans(owners map[string]string) {
+	entries, err := app.fetchSadisEntries()
+	if err == nil {
+		sadisVlans(entries, owners)
+		return
+	}
+	if app.snapshot == nil {
+		log.Warnf("%s, no SADIS subscribers are known", err)
+		return
+	}
+	log.Warnf("%s, using SADIS subscribers from snapshot taken %s", err, app.snapshot.Timestamp)
+	for vlan, sources := range app.snapshot.Vlans {
+		for _, source := range strings.Split(sources, ",") {
+			if strings.HasPrefix(source, SOURCE_SADIS) {
+				addSource(owners, vlan, source)
+			}
+		}
+	}
+}
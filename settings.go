@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	SETTINGS_KEY = "letmein"
+)
+
+/*
+ * Settings are the configuration values that may also be set in the ONOS
+ * network configuration, under apps/<app ID>/letmein, so that letmein can be
+ * reconfigured by pushing network configuration rather than restarting it.
+ * The JSON names are those used in the network configuration.
+ */
+type Settings struct {
+	OvsDpid             string   `json:"ovsDpid"`
+	OvsPort             string   `json:"ovsPort"`
+	OutputPort          string   `json:"outputPort"`
+	CreateFlowTemplate  string   `json:"createFlowTemplate"`
+	ForwardFlowTemplate string   `json:"forwardFlowTemplate"`
+	ReverseFlowTemplate string   `json:"reverseFlowTemplate"`
+	VlanInclude         []string `json:"vlanInclude"`
+	VlanExclude         []string `json:"vlanExclude"`
+	Verify              bool     `json:"verify"`
+}
+
+// currentSettings returns the settings currently in use
+func (app *Application) currentSettings() Settings {
+	return Settings{
+		OvsDpid:             app.OvsDpid,
+		OvsPort:             app.OvsPort,
+		OutputPort:          app.OutputPort,
+		CreateFlowTemplate:  app.CreateFlowTemplate,
+		ForwardFlowTemplate: app.ForwardFlowTemplate,
+		ReverseFlowTemplate: app.ReverseFlowTemplate,
+		VlanInclude:         app.VlanInclude,
+		VlanExclude:         app.VlanExclude,
+		Verify:              app.Verify,
+	}
+}
+
+// useSettings puts settings into use
+func (app *Application) useSettings(settings Settings) {
+	app.OvsDpid = settings.OvsDpid
+	app.OvsPort = settings.OvsPort
+	app.OutputPort = settings.OutputPort
+	app.CreateFlowTemplate = settings.CreateFlowTemplate
+	app.ForwardFlowTemplate = settings.ForwardFlowTemplate
+	app.ReverseFlowTemplate = settings.ReverseFlowTemplate
+	app.VlanInclude = settings.VlanInclude
+	app.VlanExclude = settings.VlanExclude
+	app.Verify = settings.Verify
+	app.updateStatus(func(status *Status) {
+		status.Verify = app.Verify
+	})
+}
+
+// settingsVlans converts a VLAN list from the network configuration, whose
+// items may be numbers or strings, to that of the environment, validating it
+func settingsVlans(value interface{}) ([]string, error) {
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list of VLAN IDs or ranges")
+	}
+	vlans := []string{}
+	for _, item := range items {
+		vlan := jsonString(item)
+		if _, err := parseVlanRange(vlan); err != nil {
+			return nil, err
+		}
+		vlans = append(vlans, vlan)
+	}
+	return vlans, nil
+}
+
+/*
+ * mergeSettings applies the values found in a network configuration section to
+ * the given settings. Every value is validated before any is applied, so that
+ * a section with a mistake is rejected as a whole. Unknown keys are reported,
+ * as they are most likely misspellings.
+ */
+func mergeSettings(settings Settings, section map[string]interface{}) (Settings, error) {
+	known := make(map[string]bool)
+	texts := map[string]*string{
+		"ovsDpid":             &settings.OvsDpid,
+		"ovsPort":             &settings.OvsPort,
+		"outputPort":          &settings.OutputPort,
+		"createFlowTemplate":  &settings.CreateFlowTemplate,
+		"forwardFlowTemplate": &settings.ForwardFlowTemplate,
+		"reverseFlowTemplate": &settings.ReverseFlowTemplate,
+	}
+	for key, field := range texts {
+		known[key] = true
+		if value, ok := section[key]; ok {
+			text, ok := value.(string)
+			if !ok || text == "" {
+				return settings, fmt.Errorf("'%s' must be a non-empty string", key)
+			}
+			*field = text
+		}
+	}
+
+	lists := map[string]*[]string{
+		"vlanInclude": &settings.VlanInclude,
+		"vlanExclude": &settings.VlanExclude,
+	}
+	for key, field := range lists {
+		known[key] = true
+		if value, ok := section[key]; ok {
+			vlans, err := settingsVlans(value)
+			if err != nil {
+				return settings, fmt.Errorf("'%s' : %s", key, err)
+			}
+			*field = vlans
+		}
+	}
+
+	known["verify"] = true
+	if value, ok := section["verify"]; ok {
+		verify, ok := value.(bool)
+		if !ok {
+			return settings, fmt.Errorf("'verify' must be true or false")
+		}
+		settings.Verify = verify
+	}
+
+	unknown := []string{}
+	for key := range section {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		log.Warnf("Ignoring unknown settings in network configuration : %v", unknown)
+	}
+	return settings, nil
+}
+
+// settingsChanges describes the differences between two sets of settings,
+// by their JSON names
+func settingsChanges(from, to Settings) []string {
+	changes := []string{}
+	a, b := reflect.ValueOf(from), reflect.ValueOf(to)
+	for i := 0; i < a.NumField(); i++ {
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			name := strings.Split(a.Type().Field(i).Tag.Get("json"), ",")[0]
+			changes = append(changes, fmt.Sprintf("%s=%v", name, b.Field(i).Interface()))
+		}
+	}
+	return changes
+}
+
+/*
+ * applySettings reads the settings in the network configuration and puts
+ * them into use, on top of those from the environment. As the settings are
+ * read every synchronization, removing one from the network configuration
+ * restores the value from the environment. Should the network configuration
+ * be unavailable, or the settings invalid, the settings in use are kept. The
+ * settings are not applied when planning, which changes nothing.
+ */
+func (app *Application) applySettings() {
+	if !app.NetcfgSettings {
+		return
+	}
+	if app.defaults == nil {
+		defaults := app.currentSettings()
+		app.defaults = &defaults
+	}
+
+	netcfg, err := app.fetchNetcfg()
+	if err != nil {
+		log.Warnf("Unable to read settings from ONOS network configuration, keeping current settings : %s", err)
+		return
+	}
+	settings := *app.defaults
+	if netcfg.Exists(APPS, APP_ID, SETTINGS_KEY) {
+		section, ok := netcfg.Search(APPS, APP_ID, SETTINGS_KEY).Data().(map[string]interface{})
+		if !ok {
+			log.Errorf("Invalid settings in ONOS network configuration, keeping current settings : expected an object")
+			return
+		}
+		if settings, err = mergeSettings(settings, section); err != nil {
+			log.Errorf("Invalid settings in ONOS network configuration, keeping current settings : %s", err)
+			return
+		}
+	}
+
+	if changes := settingsChanges(app.currentSettings(), settings); len(changes) > 0 {
+		log.Infof("Settings changed by ONOS network configuration : %s", strings.Join(changes, ", "))
+		app.useSettings(settings)
+	}
+}
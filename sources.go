@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SOURCE_YAML = "yaml:"
+	SOURCE_JSON = "json:"
+
+	NETCFG = "netcfg"
+
+	COMPOSE_UNION      = "union"
+	COMPOSE_PRECEDENCE = "precedence"
+)
+
+// DesiredStateSource provides a set of VLANs for which rules are required,
+// each mapped to the source(s) that require it
+type DesiredStateSource interface {
+	Name() string
+	Vlans() (map[string]string, error)
+}
+
+// SourceHealth reports the outcome of the most recent query of a source
+type SourceHealth struct {
+	Name        string    `json:"name"`
+	Healthy     bool      `json:"healthy"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastSuccess time.Time `json:"lastSuccess"`
+	Vlans       int       `json:"vlans"`
+}
+
+// netcfgSource reads the VLANs from the ONOS network configuration
+type netcfgSource struct {
+	app *Application
+}
+
+func (source *netcfgSource) Name() string {
+	return NETCFG
+}
+
+func (source *netcfgSource) Vlans() (map[string]string, error) {
+	return source.app.desiredVlans()
+}
+
+/*
+ * vlanDocument is the format of JSON files and HTTP endpoints. Each element of
+ * "vlans" may be anything that is accepted as a VLAN in the network
+ * configuration, e.g.
+ *
+ *     {"vlans": [100, "200-299", "300,301"]}
+ */
+type vlanDocument struct {
+	Vlans []interface{} `json:"vlans"`
+}
+
+func documentVlans(doc *vlanDocument, name string) map[string]string {
+	owners := make(map[string]string)
+	for _, value := range doc.Vlans {
+		for _, vlan := range expandVlans(value, name) {
+			addSource(owners, vlan, name)
+		}
+	}
+	return owners
+}
+
+// jsonFileSource reads VLANs from a local JSON file, e.g. one mounted from
+// a ConfigMap
+type jsonFileSource struct {
+	path string
+}
+
+func (source *jsonFileSource) Name() string {
+	return SOURCE_JSON + source.path
+}
+
+func (source *jsonFileSource) Vlans() (map[string]string, error) {
+	data, err := readFile(source.path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read VLANs from '%s' : %s", source.path, err)
+	}
+	var doc vlanDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("Unable to parse VLANs from '%s' : %s", source.path, err)
+	}
+	return documentVlans(&doc, source.Name()), nil
+}
+
+/*
+ * yamlFileSource reads VLANs from a static YAML file. Only the subset of YAML
+ * needed to express a VLAN list is understood, either as a block sequence or a
+ * flow sequence, with comments:
+ *
+ *     # infrastructure VLANs
+ *     vlans:
+ *       - 100
+ *       - "200-299"
+ *
+ *     vlans: [100, "200-299"]
+ *
+ * So that a mistyped file does not remove every VLAN's rules, a file without a
+ * top level "vlans" key, or with more than one, is an error.
+ */
+type yamlFileSource struct {
+	path string
+}
+
+func (source *yamlFileSource) Name() string {
+	return SOURCE_YAML + source.path
+}
+
+// yamlScalar converts a YAML scalar to the value that would be found in JSON
+func yamlScalar(value string) interface{} {
+	value = strings.TrimSpace(value)
+	if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+		return value[1 : len(value)-1]
+	}
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		return number
+	}
+	return value
+}
+
+// yamlStripComment removes a comment, i.e. a "#" that is not quoted and
+// starts the line or follows a space, from a line
+func yamlStripComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// yamlFlowItems splits the contents of a flow sequence on the commas that
+// are not quoted
+func yamlFlowItems(value string) []string {
+	items := []string{}
+	var quote byte
+	start := 0
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ',':
+			items = append(items, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, value[start:])
+}
+
+func (source *yamlFileSource) Vlans() (map[string]string, error) {
+	data, err := readFile(source.path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read VLANs from '%s' : %s", source.path, err)
+	}
+
+	var doc vlanDocument
+	inVlans, found := false, false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(yamlStripComment(scanner.Text()), " \t")
+		trimmed := strings.TrimSpace(text)
+		if trimmed == "" || trimmed == "---" {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(text, "vlans:"):
+			if found {
+				return nil, fmt.Errorf("Unable to parse VLANs from '%s' : line %d : duplicate key 'vlans'", source.path, line)
+			}
+			inVlans, found = true, true
+			rest := strings.TrimSpace(strings.TrimPrefix(trimmed, "vlans:"))
+			if rest == "" {
+				continue
+			}
+			if !strings.HasPrefix(rest, "[") || !strings.HasSuffix(rest, "]") {
+				return nil, fmt.Errorf("Unable to parse VLANs from '%s' : line %d : expected a sequence", source.path, line)
+			}
+			for _, item := range yamlFlowItems(rest[1 : len(rest)-1]) {
+				if strings.TrimSpace(item) != "" {
+					doc.Vlans = append(doc.Vlans, yamlScalar(item))
+				}
+			}
+			inVlans = false
+		case inVlans && strings.HasPrefix(trimmed, "-"):
+			doc.Vlans = append(doc.Vlans, yamlScalar(strings.TrimPrefix(trimmed, "-")))
+		case text[0] != ' ' && text[0] != '\t':
+			// Some other top level key, which is ignored
+			inVlans = false
+		default:
+			if inVlans {
+				return nil, fmt.Errorf("Unable to parse VLANs from '%s' : line %d : expected a sequence item", source.path, line)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Unable to read VLANs from '%s' : %s", source.path, err)
+	}
+	if !found {
+		return nil, fmt.Errorf("Unable to parse VLANs from '%s' : no top level key 'vlans'", source.path)
+	}
+	return documentVlans(&doc, source.Name()), nil
+}
+
+// httpSource reads VLANs from an arbitrary HTTP endpoint that returns the
+// same format as a JSON file source
+type httpSource struct {
+	app *Application
+	url string
+}
+
+func (source *httpSource) Name() string {
+	return source.url
+}
+
+func (source *httpSource) Vlans() (map[string]string, error) {
+	wrapper, err := source.app.fetchJSON(source.url)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to query VLANs from '%s' : %s", source.url, err)
+	}
+	var doc vlanDocument
+	if wrapper.Exists("vlans") {
+		vlans, ok := wrapper.Path("vlans").Data().([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("Unable to decode VLANs from '%s' : expected an array of VLANs", source.url)
+		}
+		doc.Vlans = vlans
+	}
+	return documentVlans(&doc, source.Name()), nil
+}
+
+// newSource creates a desired state source from its configured description,
+// i.e. "netcfg", "yaml:<file>", "json:<file>" or an http(s) URL
+func (app *Application) newSource(spec string) (DesiredStateSource, error) {
+	switch {
+	case spec == NETCFG:
+		return &netcfgSource{app: app}, nil
+	case strings.HasPrefix(spec, SOURCE_YAML):
+		return &yamlFileSource{path: strings.TrimPrefix(spec, SOURCE_YAML)}, nil
+	case strings.HasPrefix(spec, SOURCE_JSON):
+		return &jsonFileSource{path: strings.TrimPrefix(spec, SOURCE_JSON)}, nil
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return &httpSource{app: app, url: spec}, nil
+	}
+	return nil, fmt.Errorf("Unknown desired state source '%s'", spec)
+}
+
+/*
+ * desiredState queries the desired state sources and combines their VLANs.
+ * With "union" composition the VLANs of every source are merged and, so that
+ * flows are not deleted because one source is temporarily unavailable, any
+ * failure is an error. With "precedence" composition the sources are tried in
+ * order and the first to respond is used.
+ */
+func (app *Application) desiredState() (map[string]string, error) {
+	owners := make(map[string]string)
+	health := make([]SourceHealth, len(app.sources))
+	var failure error
+	found := false
+
+	for i, source := range app.sources {
+		health[i] = app.sourceHealth(source.Name())
+		if found && app.DesiredCompose == COMPOSE_PRECEDENCE {
+			continue
+		}
+		vlans, err := source.Vlans()
+		if err != nil {
+			health[i].Healthy = false
+			health[i].LastError = err.Error()
+			if failure == nil {
+				failure = err
+			}
+			if app.DesiredCompose == COMPOSE_PRECEDENCE {
+				log.Warnf("Desired state source %s failed, trying next source : %s", source.Name(), err)
+			}
+			continue
+		}
+		health[i].Healthy = true
+		health[i].LastError = ""
+		health[i].LastSuccess = time.Now().UTC()
+		health[i].Vlans = len(vlans)
+		for vlan, sources := range vlans {
+			for _, name := range strings.Split(sources, ",") {
+				addSource(owners, vlan, name)
+			}
+		}
+		found = true
+	}
+	app.updateStatus(func(status *Status) {
+		status.DesiredSources = health
+	})
+
+	if app.DesiredCompose == COMPOSE_PRECEDENCE {
+		if !found {
+			return nil, failure
+		}
+		return owners, nil
+	}
+	if failure != nil {
+		return nil, failure
+	}
+	return owners, nil
+}
+
+// sourceHealth returns the last known health of the named source
+func (app *Application) sourceHealth(name string) SourceHealth {
+	for _, health := range app.currentStatus().DesiredSources {
+		if health.Name == name {
+			return health
+		}
+	}
+	return SourceHealth{Name: name}
+}
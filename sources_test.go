@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// vlanFile writes the content of a desired state file, returning its path
+func vlanFile(t *testing.T, content string) string {
+	file, err := ioutil.TempFile("", "letmein")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+// vlanList returns the VLANs of a source, all owned by the source, e.g.
+// "100,200"
+func vlanList(t *testing.T, source DesiredStateSource, owners map[string]string) string {
+	vlans := []string{}
+	for vlan, owner := range owners {
+		if owner != source.Name() {
+			t.Errorf("%s: VLAN %s owned by '%s'", source.Name(), vlan, owner)
+		}
+		vlans = append(vlans, vlan)
+	}
+	sort.Strings(vlans)
+	return strings.Join(vlans, ",")
+}
+
+func TestYamlScalar(t *testing.T) {
+	for _, test := range []struct {
+		value  string
+		scalar interface{}
+	}{
+		{" 100 ", 100.0},
+		{`"100"`, "100"},
+		{`'200-299'`, "200-299"},
+		{`"100'`, `"100'`},
+		{`"`, `"`},
+		{"abc", "abc"},
+		{"", ""},
+	} {
+		if scalar := yamlScalar(test.value); !reflect.DeepEqual(scalar, test.scalar) {
+			t.Errorf("'%s' converted to %#v, expected %#v", test.value, scalar, test.scalar)
+		}
+	}
+}
+
+func TestYamlFileSource(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		content string
+		vlans   string
+		valid   bool
+	}{
+		{"block sequence", "vlans:\n  - 100\n  - \"200-201\"\n  - '300'\n", "100,200,201,300", true},
+		{"unindented block sequence", "vlans:\n- 100\n- 200\n", "100,200", true},
+		{"flow sequence", "vlans: [100, \"200-201\", '300']\n", "100,200,201,300", true},
+		{"quoted list in flow sequence", "vlans: [\"100,200\", 300]\n", "100,200,300", true},
+		{"empty flow sequence", "vlans: []\n", "", true},
+		{"empty block sequence", "vlans:\nother: 1\n", "", true},
+		{"comments", "# VLANs\n---\nvlans: # required\n  - 100 # first\n\n  # - 200\n  - 300\n", "100,300", true},
+		{"hash in value", "vlans:\n  - \"100#1\"\n  - 200#2\n", "", true},
+		{"other keys", "name: olt\nvlans:\n  - 100\nports:\n  - 200\n", "100", true},
+		{"invalid VLANs skipped", "vlans:\n  - 0\n  - abc\n  - 100\n  - 5000\n", "100", true},
+		{"windows line endings", "vlans:\r\n  - 100\r\n", "100", true},
+		{"no vlans key", "vlan:\n  - 100\n", "", false},
+		{"empty file", "", "", false},
+		{"nested vlans key", "olt:\n  vlans:\n    - 100\n", "", false},
+		{"duplicate vlans key", "vlans: [100]\nvlans: [200]\n", "", false},
+		{"scalar", "vlans: 100\n", "", false},
+		{"unterminated flow sequence", "vlans: [100, 200\n", "", false},
+		{"multi-line flow sequence", "vlans: [100,\n  200]\n", "", false},
+		{"mapping in sequence", "vlans:\n  - 100\n  other: 200\n", "", false},
+	} {
+		path := vlanFile(t, test.content)
+		source := &yamlFileSource{path: path}
+		owners, err := source.Vlans()
+		os.Remove(path)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: returned error %v, expected valid %t", test.name, err, test.valid)
+			continue
+		}
+		if vlans := vlanList(t, source, owners); vlans != test.vlans {
+			t.Errorf("%s: returned VLANs '%s', expected '%s'", test.name, vlans, test.vlans)
+		}
+	}
+}
+
+func TestJsonFileSource(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		content string
+		vlans   string
+		valid   bool
+	}{
+		{"array", `{"vlans": [100, "200-201", "300,301"]}`, "100,200,201,300,301", true},
+		{"empty", `{"vlans": []}`, "", true},
+		{"invalid VLANs skipped", `{"vlans": [0, "abc", 100, true]}`, "100", true},
+		{"not an array", `{"vlans": "100"}`, "", false},
+		{"not JSON", "vlans: [100]", "", false},
+	} {
+		path := vlanFile(t, test.content)
+		source := &jsonFileSource{path: path}
+		owners, err := source.Vlans()
+		os.Remove(path)
+		if (err == nil) != test.valid {
+			t.Errorf("%s: returned error %v, expected valid %t", test.name, err, test.valid)
+			continue
+		}
+		if vlans := vlanList(t, source, owners); vlans != test.vlans {
+			t.Errorf("%s: returned VLANs '%s', expected '%s'", test.name, vlans, test.vlans)
+		}
+	}
+
+	source := &jsonFileSource{path: "/nonexistent/vlans.json"}
+	if _, err := source.Vlans(); err == nil {
+		t.Errorf("Missing file did not return an error")
+	}
+}
+
+func TestHttpSource(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		status int
+		body   string
+		vlans  string
+		valid  bool
+	}{
+		{"array", http.StatusOK, `{"vlans": [100, "200-201"]}`, "100,200,201", true},
+		{"no vlans", http.StatusOK, `{}`, "", true},
+		{"not an array", http.StatusOK, `{"vlans": 100}`, "", false},
+		{"not JSON", http.StatusOK, `vlans: [100]`, "", false},
+		{"error", http.StatusInternalServerError, `{"vlans": [100]}`, "", false},
+	} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			fmt.Fprint(w, test.body)
+		}))
+		source := &httpSource{app: newApplication(), url: server.URL}
+		owners, err := source.Vlans()
+		server.Close()
+		if (err == nil) != test.valid {
+			t.Errorf("%s: returned error %v, expected valid %t", test.name, err, test.valid)
+			continue
+		}
+		if vlans := vlanList(t, source, owners); vlans != test.vlans {
+			t.Errorf("%s: returned VLANs '%s', expected '%s'", test.name, vlans, test.vlans)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Snapshot is the last successfully determined desired state, persisted so
+// that letmein can continue to maintain flows while ONOS network
+// configuration is unavailable
+type Snapshot struct {
+	Timestamp time.Time         `json:"timestamp"`
+	Switch    string            `json:"switch"`
+	Port      string            `json:"port"`
+	Vlans     map[string]string `json:"vlans"`
+
+	Objectives map[string]*Objective `json:"objectives,omitempty"`
+}
+
+// loadSnapshot reads a previously saved snapshot from the given file
+func loadSnapshot(path string) (*Snapshot, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	return &snapshot, nil
+}
+
+// saveSnapshot records the snapshot as the last known desired state and, if
+// a state file is configured, persists it along with the objectives issued
+func (app *Application) saveSnapshot(snapshot *Snapshot) {
+	snapshot.Timestamp = time.Now().UTC()
+	app.snapshot = snapshot
+	app.setStale(time.Time{})
+	app.persistSnapshot()
+}
+
+// persistSnapshot writes the snapshot to the state file, if configured
+func (app *Application) persistSnapshot() {
+	app.snapshot.Objectives = app.objectives
+	if app.StateFile == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(app.snapshot, "", "    ")
+	if err != nil {
+		log.Errorf("Unable to encode desired state snapshot : %s", err)
+		return
+	}
+	if err := writeFileAtomic(app.StateFile, data); err != nil {
+		log.Errorf("Unable to save desired state snapshot to '%s' : %s", app.StateFile, err)
+	}
+}
+
+// writeFileAtomic writes data to a file, which is replaced atomically so
+// that a crash mid-write does not leave it corrupt. The file keeps its
+// permissions, a new file is readable by all.
+func writeFileAtomic(path string, data []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".letmein")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
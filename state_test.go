@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// leftovers returns the temporary files left in a directory by atomic writes
+func leftovers(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, ".letmein*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		existing string
+		mode     os.FileMode
+		path     string
+		valid    bool
+		expected os.FileMode
+	}{
+		{"new file", "", 0, "state.json", true, 0644},
+		{"replaced file keeps permissions", "old", 0600, "state.json", true, 0600},
+		{"replaced readable file", "old", 0640, "state.json", true, 0640},
+		{"missing directory", "", 0, "missing/state.json", false, 0},
+		{"directory", "", 0, "", false, 0},
+	} {
+		dir, err := ioutil.TempDir("", "letmein")
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, test.path)
+		if test.existing != "" {
+			if err := ioutil.WriteFile(path, []byte(test.existing), test.mode); err != nil {
+				t.Fatal(err)
+			}
+			os.Chmod(path, test.mode)
+		}
+
+		err = writeFileAtomic(path, []byte("new"))
+		if (err == nil) != test.valid {
+			t.Errorf("%s: returned error %v, expected valid %t", test.name, err, test.valid)
+		}
+		if files := leftovers(t, dir); len(files) > 0 {
+			t.Errorf("%s: left temporary files %v", test.name, files)
+		}
+		if test.valid {
+			if data, _ := ioutil.ReadFile(path); string(data) != "new" {
+				t.Errorf("%s: file contains '%s', expected 'new'", test.name, data)
+			}
+			if info, err := os.Stat(path); err != nil || info.Mode().Perm() != test.expected {
+				t.Errorf("%s: file has mode %v (%v), expected %v", test.name, info.Mode().Perm(), err, test.expected)
+			}
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "letmein")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	app := newApplication()
+	app.StateFile = filepath.Join(dir, "state.json")
+	app.objectives = map[string]*Objective{
+		"100": {Vlan: "100", Port: "1", Rule: json.RawMessage(`{"priority":32768}`)},
+	}
+	app.saveSnapshot(&Snapshot{
+		Switch: testSwitch,
+		Port:   "1",
+		Vlans:  map[string]string{"100": "netcfg:olt", "200": "yaml:vlans.yaml"},
+	})
+	if app.snapshot == nil || app.snapshot.Timestamp.IsZero() {
+		t.Fatalf("Snapshot was not recorded")
+	}
+
+	snapshot, err := loadSnapshot(app.StateFile)
+	if err != nil {
+		t.Fatalf("Unable to load snapshot : %s", err)
+	}
+	if !snapshot.Timestamp.Equal(app.snapshot.Timestamp) || snapshot.Switch != testSwitch || snapshot.Port != "1" {
+		t.Errorf("Loaded snapshot %+v, expected %+v", snapshot, app.snapshot)
+	}
+	if !reflect.DeepEqual(snapshot.Vlans, app.snapshot.Vlans) {
+		t.Errorf("Loaded VLANs %v, expected %v", snapshot.Vlans, app.snapshot.Vlans)
+	}
+	rule := bytes.NewBuffer(nil)
+	if objective := snapshot.Objectives["100"]; objective == nil || json.Compact(rule, objective.Rule) != nil || rule.String() != `{"priority":32768}` {
+		t.Errorf("Loaded objectives %v, expected %v", snapshot.Objectives, app.objectives)
+	}
+
+	ioutil.WriteFile(app.StateFile, []byte("{"), 0644)
+	if _, err := loadSnapshot(app.StateFile); err == nil {
+		t.Errorf("Corrupt snapshot did not return an error")
+	}
+	if _, err := loadSnapshot(filepath.Join(dir, "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("Missing snapshot returned error %v, expected not exist", err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"github.com/Jeffail/gabs"
+	"sort"
+	"time"
+)
+
+// vlanStats tracks the traffic counters of the rules of a VLAN between
+// synchronizations
+type vlanStats struct {
+	packets    float64
+	bytes      float64
+	sampled    time.Time
+	lastActive time.Time
+	idle       bool
+}
+
+// flowCounter returns the value of a counter of a flow, which ONOS reports as
+// a number
+func flowCounter(flow *gabs.Container, name string) float64 {
+	value, _ := flow.Path(name).Data().(float64)
+	return value
+}
+
+/*
+ * collectStats samples the packet and byte counters of the managed flows and
+ * exports the rate of each VLAN's traffic. A flow counts towards the VLAN of
+ * the rule it matches the selector of, as in forward mode a reverse rule
+ * matches the VLAN the traffic leaves with, if any. The flows that the
+ * pipeline driver programs for objectives may have other criteria than the
+ * rules, so count towards the VLAN they match. A VLAN whose rules have seen no
+ * traffic for the idle period is flagged as idle, which usually indicates a
+ * dead subscriber or misconfigured OLT. As the counters of a rule restart when
+ * it is replaced, a counter that goes backwards is taken to have restarted.
+ */
+func (app *Application) collectStats(flows []*gabs.Container, owners map[string]string, need map[string]*DesiredFlow) {
+	now := time.Now()
+	codec := app.codec()
+	packets := make(map[string]float64)
+	bytes := make(map[string]float64)
+	for _, flow := range flows {
+		vlan := ""
+		if want, ok := need[flowSelector(codec, flow)]; ok {
+			vlan = want.Vlan
+		} else if app.Programming == PROGRAM_OBJECTIVES {
+			vlan, _ = codec.FlowMatch(flow)
+		}
+		if _, ok := owners[vlan]; !ok {
+			continue
+		}
+		packets[vlan] += flowCounter(flow, "packets")
+		bytes[vlan] += flowCounter(flow, "bytes")
+	}
+
+	for vlan := range app.stats {
+		if _, ok := packets[vlan]; !ok {
+			delete(app.stats, vlan)
+			metrics.Delete("letmein_vlan_packets_per_second", "vlan", vlan)
+			metrics.Delete("letmein_vlan_bytes_per_second", "vlan", vlan)
+			metrics.Delete("letmein_vlan_idle", "vlan", vlan)
+		}
+	}
+
+	idle := []string{}
+	for vlan, count := range packets {
+		stats, ok := app.stats[vlan]
+		if !ok {
+			app.stats[vlan] = &vlanStats{
+				packets:    count,
+				bytes:      bytes[vlan],
+				sampled:    now,
+				lastActive: now,
+			}
+			continue
+		}
+
+		packetDelta, byteDelta := count-stats.packets, bytes[vlan]-stats.bytes
+		if packetDelta < 0 || byteDelta < 0 {
+			packetDelta, byteDelta = count, bytes[vlan]
+		}
+		if elapsed := now.Sub(stats.sampled).Seconds(); elapsed > 0 {
+			metrics.Set("letmein_vlan_packets_per_second", packetDelta/elapsed, "vlan", vlan)
+			metrics.Set("letmein_vlan_bytes_per_second", byteDelta/elapsed, "vlan", vlan)
+		}
+		stats.packets, stats.bytes, stats.sampled = count, bytes[vlan], now
+		if packetDelta > 0 {
+			stats.lastActive = now
+		}
+
+		if app.IdlePeriod <= 0 {
+			continue
+		}
+		wasIdle := stats.idle
+		stats.idle = now.Sub(stats.lastActive) >= app.IdlePeriod
+		switch {
+		case stats.idle && !wasIdle:
+			log.Warnf("VLAN %s has seen no traffic for %s, the subscriber or OLT may be down or misconfigured",
+				vlan, now.Sub(stats.lastActive)/time.Second*time.Second)
+		case !stats.idle && wasIdle:
+			log.Infof("VLAN %s is seeing traffic again", vlan)
+		}
+		value := 0.0
+		if stats.idle {
+			value = 1
+			idle = append(idle, vlan)
+		}
+		metrics.Set("letmein_vlan_idle", value, "vlan", vlan)
+	}
+
+	sort.Strings(idle)
+	app.updateStatus(func(status *Status) {
+		status.IdleVlans = idle
+	})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Status summarizes the state of synchronization for operators
+type Status struct {
+	LastSync       time.Time         `json:"lastSync"`
+	LastError      string            `json:"lastError,omitempty"`
+	Failures       int               `json:"failures"`
+	Switch         string            `json:"switch,omitempty"`
+	Port           string            `json:"port,omitempty"`
+	OnosVersion    string            `json:"onosVersion,omitempty"`
+	Epoch          int               `json:"epoch"`
+	Vlans          int               `json:"vlans"`
+	Sources        map[string]string `json:"sources,omitempty"`
+	DesiredSources []SourceHealth    `json:"desiredSources,omitempty"`
+	Stale          bool              `json:"stale"`
+	SnapshotTime   time.Time         `json:"snapshotTime"`
+	IdleVlans      []string          `json:"idleVlans,omitempty"`
+	Conflicts      []Conflict        `json:"conflicts,omitempty"`
+	Overrides      []Override        `json:"overrides,omitempty"`
+	Paused         bool              `json:"paused"`
+	Verify         bool              `json:"verify"`
+}
+
+// updateStatus modifies the status while holding the lock that protects it
+// from concurrent readers
+func (app *Application) updateStatus(update func(status *Status)) {
+	app.statusLock.Lock()
+	defer app.statusLock.Unlock()
+	update(&app.status)
+}
+
+// currentStatus returns a copy of the status
+func (app *Application) currentStatus() Status {
+	app.statusLock.Lock()
+	defer app.statusLock.Unlock()
+	return app.status
+}
+
+// setStale marks whether the desired state is being taken from a snapshot
+// rather than from ONOS, a zero timestamp indicates it is not
+func (app *Application) setStale(snapshot time.Time) {
+	app.updateStatus(func(status *Status) {
+		status.Stale = !snapshot.IsZero()
+		status.SnapshotTime = snapshot
+	})
+}
+
+// syncStatus records the outcome of a synchronization
+func (app *Application) syncStatus(err error, elapsed time.Duration) {
+	metrics.Inc("letmein_sync_total")
+	if err != nil {
+		metrics.Inc("letmein_sync_failures_total")
+	}
+	metrics.Set("letmein_sync_duration_seconds", elapsed.Seconds())
+	app.updateStatus(func(status *Status) {
+		status.LastSync = time.Now().UTC()
+		status.LastError = ""
+		status.Failures = app.failures
+		if err != nil {
+			status.LastError = err.Error()
+		}
+	})
+}
+
+func (app *Application) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	encoder.Encode(app.currentStatus())
+}
+
+// serveStatus serves the status of synchronization over HTTP
+func (app *Application) serveStatus() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", app.handleStatus)
+	mux.HandleFunc("/metrics", handleMetrics)
+	log.Infof("Serving status on %s", app.StatusListen)
+	if err := http.ListenAndServe(app.StatusListen, mux); err != nil {
+		log.Fatalf("Unable to serve status on '%s' : %s", app.StatusListen, err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	LINKS_URL = "%s/onos/v1/links?device=%s"
+)
+
+/*
+ * oltPorts returns the port of the switch to which each OLT is attached. The
+ * ONOS links of the switch, the ends of which are decoded as ports, are
+ * consulted first, any OLT without a link to the switch falls back to the
+ * static OLT_PORTS configuration.
+ */
+func (app *Application) oltPorts(dpid string) map[string]string {
+	ports := make(map[string]string)
+	links, err := app.fetchJSON(fmt.Sprintf(LINKS_URL, app.OnosConnectUrl, dpid))
+	if err != nil {
+		log.Warnf("Unable to query links of switch %s, using static OLT ports : %s", dpid, err)
+	} else {
+		codec := app.codec()
+		children, _ := links.Path("links").Children()
+		for _, link := range children {
+			src, _ := link.Path("src.device").Data().(string)
+			dst, _ := link.Path("dst.device").Data().(string)
+			switch {
+			case src == dpid && dst != dpid:
+				ports[dst] = codec.Port(link.Path("src")).Number
+			case dst == dpid && src != dpid:
+				ports[src] = codec.Port(link.Path("dst")).Number
+			}
+		}
+	}
+
+	for _, mapping := range app.OltPorts {
+		idx := strings.LastIndex(mapping, "=")
+		if idx <= 0 {
+			log.Warnf("Ignoring invalid OLT port mapping '%s', expected <olt>=<port>", mapping)
+			continue
+		}
+		olt, port := mapping[:idx], mapping[idx+1:]
+		if _, ok := ports[olt]; !ok {
+			ports[olt] = port
+		}
+	}
+	return ports
+}
+
+// uniOlts maps the UNI port names of the given OLTs, which are the IDs of
+// their SADIS subscribers, to the OLT
+func (app *Application) uniOlts(olts map[string]string) map[string]string {
+	unis := make(map[string]string)
+	for olt := range olts {
+		wrapper, err := app.fetchJSON(fmt.Sprintf(PORTS_URL, app.OnosConnectUrl, olt))
+		if err != nil {
+			log.Debugf("Unable to query ports of OLT %s : %s", olt, err)
+			continue
+		}
+		ports, _ := wrapper.Path("ports").Children()
+		for _, child := range ports {
+			if name, ok := app.codec().Port(child).Annotations["portName"]; ok {
+				unis[name] = olt
+			}
+		}
+	}
+	return unis
+}
+
+/*
+ * vlanPorts returns the switch port on which the traffic of each VLAN arrives.
+ * This is the port to which the OLT that requires the VLAN is attached, the
+ * OLT being the network configuration device, or for SADIS subscribers the OLT
+ * that has the subscriber's UNI port. VLANs whose OLT cannot be determined use
+ * the default port.
+ */
+func (app *Application) vlanPorts(dpid, inPort string, owners map[string]string) map[string]string {
+	ports := make(map[string]string, len(owners))
+	olts := app.oltPorts(dpid)
+
+	var unis map[string]string
+	for _, sources := range owners {
+		if strings.Contains(sources, SOURCE_SADIS) {
+			unis = app.uniOlts(olts)
+			break
+		}
+	}
+
+	for vlan, sources := range owners {
+		ports[vlan] = inPort
+		found := ""
+		for _, source := range strings.Split(sources, ",") {
+			olt := ""
+			switch {
+			case strings.HasPrefix(source, SOURCE_NETCFG):
+				olt = strings.TrimPrefix(source, SOURCE_NETCFG)
+			case strings.HasPrefix(source, SOURCE_SADIS):
+				olt = unis[strings.TrimPrefix(source, SOURCE_SADIS)]
+			}
+			port, ok := olts[olt]
+			if !ok {
+				continue
+			}
+			if found == "" {
+				found = olt
+				ports[vlan] = port
+			} else if port != ports[vlan] {
+				log.Warnf("VLAN %s is required by OLTs %s and %s on different ports, using port %s",
+					vlan, found, olt, ports[vlan])
+			}
+		}
+		if found == "" {
+			log.Debugf("Unable to determine OLT for VLAN %s, using port %s", vlan, inPort)
+		}
+	}
+	return ports
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	MIN_VLAN = 1
+	MAX_VLAN = 4094
+
+	STATIC_INCLUDE = "static:include"
+)
+
+// reservedVlans are valid VLAN IDs that are commonly reserved for other
+// purposes, they are honored but their use is warned about
+var reservedVlans = map[int]string{
+	1:    "default VLAN",
+	1002: "reserved for FDDI/token ring",
+	1003: "reserved for FDDI/token ring",
+	1004: "reserved for FDDI/token ring",
+	1005: "reserved for FDDI/token ring",
+}
+
+// parseVlanRange parses a single VLAN ID or an inclusive range of VLAN IDs,
+// e.g. "100" or "100-199"
+func parseVlanRange(value string) ([]int, error) {
+	value = strings.TrimSpace(value)
+	low, high := value, value
+	if idx := strings.Index(value, "-"); idx > 0 {
+		low, high = value[:idx], value[idx+1:]
+	}
+	from, err := strconv.Atoi(strings.TrimSpace(low))
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not a VLAN ID or range", value)
+	}
+	to, err := strconv.Atoi(strings.TrimSpace(high))
+	if err != nil {
+		return nil, fmt.Errorf("'%s' is not a VLAN ID or range", value)
+	}
+	if from > to {
+		return nil, fmt.Errorf("VLAN range '%s' is reversed", value)
+	}
+	if from < MIN_VLAN || to > MAX_VLAN {
+		return nil, fmt.Errorf("'%s' is outside the valid VLAN range %d-%d", value, MIN_VLAN, MAX_VLAN)
+	}
+	vlans := make([]int, 0, to-from+1)
+	for vlan := from; vlan <= to; vlan++ {
+		vlans = append(vlans, vlan)
+	}
+	return vlans, nil
+}
+
+/*
+ * parseVlans returns the VLAN IDs described by a network configuration value.
+ * The value may be a number, a string containing a VLAN ID, a range such as
+ * "100-199" or a comma separated list of these, or an array of any of them.
+ * Values that cannot be understood, or are not valid VLAN IDs, are skipped
+ * with a warning that names the source of the value.
+ */
+func parseVlans(value interface{}, source string) []int {
+	var ids []int
+	switch v := value.(type) {
+	case float64:
+		if v != float64(int(v)) {
+			log.Warnf("Ignoring VLAN %v from %s : not an integer", v, source)
+			return nil
+		}
+		vlans, err := parseVlanRange(strconv.Itoa(int(v)))
+		if err != nil {
+			log.Warnf("Ignoring VLAN from %s : %s", source, err)
+			return nil
+		}
+		ids = vlans
+	case string:
+		for _, part := range strings.Split(v, ",") {
+			if strings.TrimSpace(part) == "" {
+				continue
+			}
+			vlans, err := parseVlanRange(part)
+			if err != nil {
+				log.Warnf("Ignoring VLAN from %s : %s", source, err)
+				continue
+			}
+			ids = append(ids, vlans...)
+		}
+	case []interface{}:
+		for _, item := range v {
+			ids = append(ids, parseVlans(item, source)...)
+		}
+	default:
+		log.Warnf("Ignoring VLAN value '%v' of unsupported type %T from %s", value, value, source)
+		return nil
+	}
+	return ids
+}
+
+// expandVlans returns the VLAN IDs described by a network configuration value
+// as strings, warning about any that are reserved
+func expandVlans(value interface{}, source string) []string {
+	ids := parseVlans(value, source)
+	result := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if reason, ok := reservedVlans[id]; ok {
+			log.Warnf("VLAN %d from %s is %s", id, source, reason)
+		}
+		result = append(result, strconv.Itoa(id))
+	}
+	return result
+}
+
+// applyStaticVlans returns the required VLANs with the statically configured
+// includes added and excludes removed. The given map is not modified.
+func (app *Application) applyStaticVlans(owners map[string]string) map[string]string {
+	result := make(map[string]string, len(owners))
+	for vlan, owner := range owners {
+		result[vlan] = owner
+	}
+	for _, include := range app.VlanInclude {
+		for _, vlan := range expandVlans(include, "VLAN_INCLUDE") {
+			if _, ok := result[vlan]; !ok {
+				result[vlan] = STATIC_INCLUDE
+			}
+		}
+	}
+	for _, exclude := range app.VlanExclude {
+		for _, id := range parseVlans(exclude, "VLAN_EXCLUDE") {
+			vlan := strconv.Itoa(id)
+			if owner, ok := result[vlan]; ok {
+				log.Debugf("Excluding VLAN %s required by %s", vlan, owner)
+				delete(result, vlan)
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseVlanRange(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		vlans []int
+		valid bool
+	}{
+		{"100", []int{100}, true},
+		{" 100 ", []int{100}, true},
+		{"100-103", []int{100, 101, 102, 103}, true},
+		{"100 - 101", []int{100, 101}, true},
+		{"4094", []int{4094}, true},
+		{"1-1", []int{1}, true},
+		{"0", nil, false},
+		{"4095", nil, false},
+		{"4090-4095", nil, false},
+		{"103-100", nil, false},
+		{"-100", nil, false},
+		{"100-", nil, false},
+		{"abc", nil, false},
+		{"", nil, false},
+		{"100-200-300", nil, false},
+	} {
+		vlans, err := parseVlanRange(test.value)
+		if (err == nil) != test.valid {
+			t.Errorf("Parsing '%s' returned error %v, expected valid %t", test.value, err, test.valid)
+			continue
+		}
+		if !reflect.DeepEqual(vlans, test.vlans) {
+			t.Errorf("Parsing '%s' returned %v, expected %v", test.value, vlans, test.vlans)
+		}
+	}
+}
+
+func TestParseVlans(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		value interface{}
+		vlans []int
+	}{
+		{"number", 100.0, []int{100}},
+		{"fractional number", 100.5, nil},
+		{"number out of range", 5000.0, nil},
+		{"string", "200", []int{200}},
+		{"range", "200-202", []int{200, 201, 202}},
+		{"list", "200, 300-301,", []int{200, 300, 301}},
+		{"list with invalid item", "200,abc,0,300", []int{200, 300}},
+		{"array", []interface{}{100.0, "200-201", "300,301"}, []int{100, 200, 201, 300, 301}},
+		{"nested array", []interface{}{[]interface{}{100.0}, "x"}, []int{100}},
+		{"empty string", "", nil},
+		{"boolean", true, nil},
+		{"object", map[string]interface{}{"vlan": 100.0}, nil},
+		{"null", nil, nil},
+	} {
+		if vlans := parseVlans(test.value, "test"); !reflect.DeepEqual(vlans, test.vlans) {
+			t.Errorf("%s: parsed %v, expected %v", test.name, vlans, test.vlans)
+		}
+	}
+}
+
+func TestApplyStaticVlans(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		owners  map[string]string
+		include []string
+		exclude []string
+		result  map[string]string
+	}{
+		{"none", map[string]string{"100": "netcfg:a"}, nil, nil,
+			map[string]string{"100": "netcfg:a"}},
+		{"include", map[string]string{"100": "netcfg:a"}, []string{"100-101", "300"}, nil,
+			map[string]string{"100": "netcfg:a", "101": STATIC_INCLUDE, "300": STATIC_INCLUDE}},
+		{"exclude", map[string]string{"100": "netcfg:a", "101": "netcfg:b", "200": "netcfg:c"}, nil, []string{"100-150"},
+			map[string]string{"200": "netcfg:c"}},
+		{"exclude wins over include", nil, []string{"100-102"}, []string{"101"},
+			map[string]string{"100": STATIC_INCLUDE, "102": STATIC_INCLUDE}},
+		{"invalid ignored", map[string]string{"100": "netcfg:a"}, []string{"abc"}, []string{"0"},
+			map[string]string{"100": "netcfg:a"}},
+	} {
+		app := &Application{VlanInclude: test.include, VlanExclude: test.exclude}
+		owners := make(map[string]string)
+		for vlan, owner := range test.owners {
+			owners[vlan] = owner
+		}
+		result := app.applyStaticVlans(owners)
+		if !reflect.DeepEqual(result, test.result) {
+			t.Errorf("%s: resulted in %v, expected %v", test.name, result, test.result)
+		}
+		if !reflect.DeepEqual(owners, test.owners) && len(test.owners) > 0 {
+			t.Errorf("%s: modified the required VLANs to %v", test.name, owners)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	DEVICE_URL = "%s/onos/v1/devices/%s"
+)
+
+func (app *Application) fetchDeviceState(client *http.Client, dpid string) (*Device, error) {
+	wrapper, err := getJSON(client, fmt.Sprintf(DEVICE_URL, app.OnosConnectUrl, dpid))
+	if err != nil {
+		return nil, err
+	}
+	device := app.codec().Device(wrapper)
+	return &device, nil
+}
+
+// trigger requests an immediate synchronization, without waiting for the
+// next interval. Requests made while one is already pending are coalesced.
+func (app *Application) trigger(reason string) {
+	select {
+	case app.triggers <- reason:
+	default:
+	}
+}
+
+/*
+ * watchSwitch polls the availability of the managed switch far more frequently
+ * than the synchronization interval. When the switch reconnects, seen either as
+ * the device becoming available or its last update time changing while it is
+ * available, ONOS may have dropped its flows, so the switch epoch is advanced and
+ * an immediate synchronization is triggered to restore them.
+ */
+func (app *Application) watchSwitch() {
+	var watching string
+	var seen, available bool
+	var lastUpdate string
+	epoch := 0
+
+	// Polled with a client of its own, so that the polling is not recorded
+	// along with the synchronizations
+	client := &http.Client{}
+
+	for {
+		time.Sleep(app.WatchInterval)
+
+		dpid := app.currentStatus().Switch
+		if dpid == "" {
+			continue
+		}
+		if dpid != watching {
+			// A different switch, start afresh
+			watching = dpid
+			seen = false
+			available = false
+			lastUpdate = ""
+		}
+
+		state, err := app.fetchDeviceState(client, dpid)
+		if err != nil {
+			log.Debugf("Unable to query availability of switch %s : %s", dpid, err)
+			continue
+		}
+		update := state.LastUpdate
+
+		connected := state.Available && (!available || update != lastUpdate)
+		if available && !state.Available {
+			log.Warnf("Switch %s is no longer available", dpid)
+		}
+		reconnect := connected && seen
+		seen = true
+		available = state.Available
+		lastUpdate = update
+		metrics.Set("letmein_switch_available", boolValue(available), "switch", dpid)
+
+		if connected {
+			epoch++
+			metrics.Set("letmein_switch_epoch", float64(epoch), "switch", dpid)
+			app.updateStatus(func(status *Status) {
+				status.Epoch = epoch
+				if reconnect {
+					app.restoreSince = time.Now()
+				}
+			})
+		}
+		if reconnect {
+			log.Warnf("Switch %s reconnected (epoch %d), restoring flows", dpid, epoch)
+			metrics.Inc("letmein_switch_reconnects_total", "switch", dpid)
+			app.trigger(fmt.Sprintf("switch %s reconnected", dpid))
+		}
+	}
+}
+
+// restoreCompleted records the time taken to restore flows following a
+// switch reconnect, once a synchronization has succeeded
+func (app *Application) restoreCompleted(err error) {
+	if err != nil {
+		return
+	}
+	var since time.Time
+	app.updateStatus(func(status *Status) {
+		since = app.restoreSince
+		app.restoreSince = time.Time{}
+	})
+	if since.IsZero() {
+		return
+	}
+	elapsed := time.Since(since).Seconds()
+	log.Infof("Flows restored %.3fs after switch reconnect", elapsed)
+	metrics.Set("letmein_restore_seconds", elapsed)
+	metrics.Add("letmein_restore_seconds_sum", elapsed)
+	metrics.Inc("letmein_restore_seconds_count")
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
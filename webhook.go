@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"text/template"
+	"time"
+)
+
+const (
+	EVENT_FLOW_CREATED      = "flow.created"
+	EVENT_FLOW_DELETED      = "flow.deleted"
+	EVENT_SYNC_FAILED       = "sync.failed"
+	EVENT_SYNC_RECOVERED    = "sync.recovered"
+	EVENT_SWITCH_DISCOVERED = "switch.discovered"
+	EVENT_SWITCH_CHANGED    = "switch.changed"
+
+	WEBHOOK_QUEUE_SIZE = 256
+)
+
+// Event describes a change or failure of which external systems are notified
+type Event struct {
+	Type      string    `json:"type"`
+	Timestamp time.Time `json:"timestamp"`
+	Switch    string    `json:"switch,omitempty"`
+	Port      string    `json:"port,omitempty"`
+	Vlan      string    `json:"vlan,omitempty"`
+	FlowId    string    `json:"flowId,omitempty"`
+	Failures  int       `json:"failures,omitempty"`
+	Message   string    `json:"message,omitempty"`
+}
+
+// Notifier delivers events to the configured webhooks. Delivery is
+// asynchronous so that a slow or unavailable receiver does not delay
+// reconciliation.
+type Notifier struct {
+	urls       []string
+	events     map[string]bool
+	payload    *template.Template
+	retries    int
+	retryDelay time.Duration
+	interval   time.Duration
+	queue      chan *Event
+	client     *http.Client
+}
+
+// NewNotifier creates a notifier from the application configuration and
+// starts its delivery loop
+func NewNotifier(app *Application) (*Notifier, error) {
+	notifier := &Notifier{
+		urls:       app.WebhookUrls,
+		retries:    app.WebhookRetries,
+		retryDelay: app.WebhookRetryDelay,
+		queue:      make(chan *Event, WEBHOOK_QUEUE_SIZE),
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+	if len(app.WebhookEvents) > 0 {
+		notifier.events = make(map[string]bool)
+		for _, event := range app.WebhookEvents {
+			notifier.events[event] = true
+		}
+	}
+	if app.WebhookRateLimit > 0 {
+		notifier.interval = time.Minute / time.Duration(app.WebhookRateLimit)
+	}
+	if app.WebhookTemplate != "" {
+		payload := template.New(path.Base(app.WebhookTemplate)).Funcs(template.FuncMap{
+			"json": func(v interface{}) (string, error) {
+				data, err := json.Marshal(v)
+				return string(data), err
+			},
+		})
+		if _, err := payload.ParseFiles(app.WebhookTemplate); err != nil {
+			return nil, err
+		}
+		notifier.payload = payload
+	}
+	go notifier.run()
+	return notifier, nil
+}
+
+// Notify queues an event for delivery. If the queue is full the event is
+// dropped rather than blocking reconciliation.
+func (notifier *Notifier) Notify(event *Event) {
+	if notifier == nil {
+		return
+	}
+	if notifier.events != nil && !notifier.events[event.Type] {
+		return
+	}
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now().UTC()
+	}
+	select {
+	case notifier.queue <- event:
+	default:
+		log.Warnf("Webhook queue full, dropping '%s' event", event.Type)
+	}
+}
+
+func (notifier *Notifier) run() {
+	var last time.Time
+	for event := range notifier.queue {
+		// Rate limit the notifications by spacing out deliveries
+		if wait := notifier.interval - time.Since(last); wait > 0 {
+			time.Sleep(wait)
+		}
+		last = time.Now()
+
+		buf := bytes.NewBuffer(nil)
+		if notifier.payload != nil {
+			if err := notifier.payload.Execute(buf, event); err != nil {
+				log.Errorf("Unable to execute webhook payload template for '%s' event : %s", event.Type, err)
+				continue
+			}
+		} else if err := json.NewEncoder(buf).Encode(event); err != nil {
+			log.Errorf("Unable to encode webhook payload for '%s' event : %s", event.Type, err)
+			continue
+		}
+		for _, url := range notifier.urls {
+			notifier.deliver(url, event, buf.Bytes())
+		}
+	}
+}
+
+func (notifier *Notifier) deliver(url string, event *Event, payload []byte) {
+	for attempt := 0; attempt <= notifier.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(notifier.retryDelay)
+		}
+		resp, err := notifier.client.Post(url, "application/json", bytes.NewReader(payload))
+		if err != nil {
+			log.Warnf("Unable to POST '%s' event to webhook '%s' : %s", event.Type, url, err)
+			continue
+		}
+		resp.Body.Close()
+		if int(resp.StatusCode/100) != 2 {
+			log.Warnf("Error response code while POSTing '%s' event to webhook '%s' : %s", event.Type, url, resp.Status)
+			continue
+		}
+		log.Debugf("Delivered '%s' event to webhook '%s'", event.Type, url)
+		return
+	}
+	log.Errorf("Unable to deliver '%s' event to webhook '%s' after %d attempts", event.Type, url, notifier.retries+1)
+}
+
+// syncCompleted tracks consecutive synchronization failures, notifying once
+// the failure threshold is reached and again when synchronization recovers
+func (app *Application) syncCompleted(err error) {
+	threshold := app.WebhookFailureThreshold
+	if threshold < 1 {
+		threshold = 1
+	}
+	if err == nil {
+		if app.failures >= threshold {
+			app.notifier.Notify(&Event{
+				Type:     EVENT_SYNC_RECOVERED,
+				Switch:   app.switchDpid,
+				Failures: app.failures,
+			})
+		}
+		app.failures = 0
+		return
+	}
+	app.failures++
+	if app.failures == threshold {
+		app.notifier.Notify(&Event{
+			Type:     EVENT_SYNC_FAILED,
+			Switch:   app.switchDpid,
+			Failures: app.failures,
+			Message:  err.Error(),
+		})
+	}
+}
+
+// receiveCommand implements the "letmein receive" command, a minimal webhook
+// receiver that prints each payload it is sent. It is intended for testing
+// webhook configuration.
+func receiveCommand(args []string) int {
+	var listen string
+
+	flags := flag.NewFlagSet("receive", flag.ExitOnError)
+	flags.StringVar(&listen, "listen", ":9090", "address on which to receive webhook notifications")
+	flags.Parse(args)
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Printf("%s %s\n", r.URL.Path, bytes.TrimSpace(body))
+		w.WriteHeader(http.StatusNoContent)
+	})
+	log.Infof("Receiving webhook notifications on %s", listen)
+	if err := http.ListenAndServe(listen, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to listen on '%s' : %s\n", listen, err)
+		return 1
+	}
+	return 0
+}
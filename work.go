@@ -6,9 +6,7 @@ import (
 	"fmt"
 	"github.com/Jeffail/gabs"
 	"net/http"
-	"path"
-	"strconv"
-	"text/template"
+	"strings"
 )
 
 const (
@@ -24,274 +22,528 @@ const (
 	DELETE_FLOW_URL = "%s/onos/v1/flows/%s/%s"
 	APP_ID          = "com.ciena"
 	DISCOVER        = ":discover"
+	FLOW_ADDED      = "ADDED"
+	FLOW_FAILED     = "FAILED"
+
+	OUTPUT_BY_NAME       = "name:"
+	OUTPUT_BY_ANNOTATION = "annotation:"
 )
 
-type FlowWorker struct{}
+// statusError is returned when a request is answered with an error status,
+// so that callers may act on particular statuses
+type statusError struct {
+	code   int
+	status string
+}
 
-type RuleData struct {
-	AppId  string
-	DPID   string
-	VlanId string
-	InPort string
+func (err *statusError) Error() string {
+	return err.status
 }
 
-func (app *Application) Synchronize() {
+// fetchJSON performs a GET with the client through which the requests of a
+// synchronization are made, and returns the decoded JSON response
+func (app *Application) fetchJSON(url string) (*gabs.Container, error) {
+	return getJSON(app.client, url)
+}
 
-	/*
-	 * If the DPID is set to ":discover" then attempt to use hueristics to determine the device
-	 * in ONOS to use. The hueristic is simple, if the "hw" is "Open vSwtich", the "driver"
-	 * is "ovs", and it is "available" then it is our switch. The first match is taken.
-	 */
+// getJSON performs a GET with the given client and returns the decoded JSON
+// response, which may be an object or an array
+func getJSON(client *http.Client, url string) (*gabs.Container, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if int(resp.StatusCode/100) != 2 {
+		return nil, &statusError{code: resp.StatusCode, status: resp.Status}
+	}
+	var raw interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, fmt.Errorf("Unable to decode response : %s", err)
+	}
+	return gabs.Consume(raw)
+}
+
+/*
+ * If the DPID is set to ":discover" then attempt to use hueristics to determine the device
+ * in ONOS to use. The hueristic is simple, if the "hw" is "Open vSwtich", the "driver"
+ * is "ovs", and it is "available" then it is our switch. The first match is taken.
+ */
+func (app *Application) discoverSwitch() (string, error) {
 	dpid := app.OvsDpid
-	if dpid == DISCOVER {
-		resp, err := http.Get(fmt.Sprintf(DEVICES_URL, app.OnosConnectUrl))
-		if err != nil {
-			log.Errorf("Unable to discover OVS switch to configure : %s", err)
-			return
-		}
-		defer resp.Body.Close()
-		if int(resp.StatusCode/100) != 2 {
-			log.Errorf("Error response code whilst querying for devices to discover OVS switch : %s",
-				resp.Status)
-			return
-		}
-		decoder := json.NewDecoder(resp.Body)
-		var raw map[string]interface{}
-		err = decoder.Decode(&raw)
-		if err != nil {
-			log.Errorf("Unable to decode devices response from ONOS : %s", err)
-			return
-		}
-		wrapper, err := gabs.Consume(raw)
-		if err != nil {
-			log.Errorf("Unable to consume devices JSON object : %s", err)
-			return
-		}
+	if dpid != DISCOVER {
+		return dpid, nil
+	}
+	wrapper, err := app.fetchJSON(fmt.Sprintf(DEVICES_URL, app.OnosConnectUrl))
+	if err != nil {
+		return "", fmt.Errorf("Unable to query devices to discover OVS switch : %s", err)
+	}
 
-		devices, err := wrapper.Path("devices").Children()
-		if err != nil {
-			log.Errorf("Unable to query list of devices from ONOS : %s", err)
-			return
-		}
-		for _, device := range devices {
-			if device.Path("hw").Data().(string) == "Open vSwitch" &&
-				device.Path("driver").Data().(string) == "ovs" && device.Path("available").Data().(bool) {
-				dpid = device.Path("id").Data().(string)
-			}
-		}
-		if dpid == DISCOVER {
-			// Unable to discover OVS switch
-			log.Error("Unable to discover OVS switch from ONOS, please specify DPID")
-			return
+	devices, err := wrapper.Path("devices").Children()
+	if err != nil {
+		return "", fmt.Errorf("Unable to query list of devices from ONOS : %s", err)
+	}
+	codec := app.codec()
+	for _, child := range devices {
+		device := codec.Device(child)
+		if device.Hw == "Open vSwitch" && device.Driver == "ovs" && device.Available {
+			dpid = device.Id
 		}
 	}
+	if dpid == DISCOVER {
+		// Unable to discover OVS switch
+		return "", fmt.Errorf("Unable to discover OVS switch from ONOS, please specify DPID")
+	}
+	return dpid, nil
+}
 
-	/*
-	 * If the PORT is set to ":discover" then attempt to use a hueristic to determine the PORT
-	 * of the switch to use. The hueristic is simple, the first non-"local" and "enabled" port
-	 * will be used.
-	 */
+/*
+ * If the PORT is set to ":discover" then attempt to use a hueristic to determine the PORT
+ * of the switch to use. The hueristic is simple, the first non-"local" and "enabled" port
+ * will be used.
+ */
+func (app *Application) discoverPort(dpid string) (string, error) {
 	inPort := app.OvsPort
-	if inPort == DISCOVER {
-		resp, err := http.Get(fmt.Sprintf(PORTS_URL, app.OnosConnectUrl, dpid))
-		if err != nil {
-			log.Errorf("Unable to discover OVS switch ports for switch %s : %s", dpid, err)
-			return
-		}
-		defer resp.Body.Close()
-		if int(resp.StatusCode/100) != 2 {
-			log.Errorf("Error response whilst querying for device ports from switch %s : %s", dpid, err)
-			return
-		}
-		decoder := json.NewDecoder(resp.Body)
-		var raw map[string]interface{}
-		err = decoder.Decode(&raw)
-		if err != nil {
-			log.Errorf("Unable to decode ports response from ONOS : %s", err)
-			return
-		}
-		wrapper, err := gabs.Consume(raw)
-		if err != nil {
-			log.Errorf("Unable to consume ports JSON object : %s", err)
-			return
-		}
+	if inPort != DISCOVER {
+		return inPort, nil
+	}
+	wrapper, err := app.fetchJSON(fmt.Sprintf(PORTS_URL, app.OnosConnectUrl, dpid))
+	if err != nil {
+		return "", fmt.Errorf("Unable to query ports of switch %s to discover port : %s", dpid, err)
+	}
 
-		ports, err := wrapper.Path("ports").Children()
-		if err != nil {
-			log.Errorf("Unable to query list of ports from JSON object : %s", err)
-			return
-		}
-		for _, port := range ports {
-			if port.Path("isEnabled").Data().(bool) && port.Path("port").Data().(string) != "local" {
-				inPort = port.Path("port").Data().(string)
-			}
+	ports, err := wrapper.Path("ports").Children()
+	if err != nil {
+		return "", fmt.Errorf("Unable to query list of ports from JSON object : %s", err)
+	}
+	codec := app.codec()
+	for _, child := range ports {
+		port := codec.Port(child)
+		if port.Enabled && !port.Local {
+			inPort = port.Number
 		}
-		if inPort == DISCOVER {
-			// Unable to discover OVS switch port
-			log.Errorf("Unable to discover port on switch %s", dpid)
-			return
+	}
+	if inPort == DISCOVER {
+		// Unable to discover OVS switch port
+		return "", fmt.Errorf("Unable to discover port on switch %s", dpid)
+	}
+	return inPort, nil
+}
+
+/*
+ * discoverOutputPort determines the port out of which traffic is forwarded in
+ * forward mode. The port may be given by number, or as "name:<name>" to select
+ * the port with that name or "annotation:<key>=<value>" to select the port with
+ * that annotation.
+ */
+func (app *Application) discoverOutputPort(dpid string) (string, error) {
+	spec := app.OutputPort
+	if spec == "" {
+		return "", fmt.Errorf("An output port must be specified when forwarding")
+	}
+	key, value := "", ""
+	switch {
+	case strings.HasPrefix(spec, OUTPUT_BY_NAME):
+		key, value = "portName", strings.TrimPrefix(spec, OUTPUT_BY_NAME)
+	case strings.HasPrefix(spec, OUTPUT_BY_ANNOTATION):
+		parts := strings.SplitN(strings.TrimPrefix(spec, OUTPUT_BY_ANNOTATION), "=", 2)
+		if len(parts) != 2 {
+			return "", fmt.Errorf("Invalid output port '%s', expected %s<key>=<value>", spec, OUTPUT_BY_ANNOTATION)
 		}
+		key, value = parts[0], parts[1]
+	default:
+		return spec, nil
 	}
 
-	// Fetch network config to get access to the list of access device VLAN IDs
-	resp, err := http.Get(fmt.Sprintf(NETCFG_URL, app.OnosConnectUrl))
+	wrapper, err := app.fetchJSON(fmt.Sprintf(PORTS_URL, app.OnosConnectUrl, dpid))
 	if err != nil {
-		log.Warnf("Unable to read ONOS network configuration : %s", err)
-		return
+		return "", fmt.Errorf("Unable to query ports of switch %s to discover output port : %s", dpid, err)
 	}
-	defer resp.Body.Close()
-	if int(resp.StatusCode/100) != 2 {
-		log.Errorf("Unable to query ONOS network configuration : %s", resp.Status)
-		return
+	codec := app.codec()
+	ports, _ := wrapper.Path("ports").Children()
+	for _, child := range ports {
+		port := codec.Port(child)
+		if annotation, ok := port.Annotations[key]; ok && annotation == value {
+			return port.Number, nil
+		}
+	}
+	return "", fmt.Errorf("Unable to discover output port '%s' on switch %s", spec, dpid)
+}
+
+// fetchNetcfg returns the ONOS network configuration, which is fetched once
+// per synchronization for both the settings and the VLANs it holds
+func (app *Application) fetchNetcfg() (*gabs.Container, error) {
+	if app.netcfg == nil {
+		netcfg, err := app.fetchJSON(fmt.Sprintf(NETCFG_URL, app.OnosConnectUrl))
+		if err != nil {
+			return nil, err
+		}
+		app.netcfg = netcfg
 	}
-	decoder := json.NewDecoder(resp.Body)
-	var raw map[string]interface{}
-	decoder.Decode(&raw)
-	netcfg, err := gabs.Consume(raw)
+	return app.netcfg, nil
+}
+
+// desiredVlans fetches the network configuration from ONOS and returns the
+// VLANs for which rules are required, mapped to the source(s) that require each
+func (app *Application) desiredVlans() (map[string]string, error) {
+	netcfg, err := app.fetchNetcfg()
 	if err != nil {
-		log.Warnf("Unable to consume JSON : %s", err)
-		return
+		return nil, fmt.Errorf("Unable to query ONOS network configuration : %s", err)
 	}
+	return app.netcfgVlans(netcfg), nil
+}
 
+// netcfgVlans returns the VLANs required by a network configuration, mapped
+// to the source(s) that require each
+func (app *Application) netcfgVlans(netcfg *gabs.Container) map[string]string {
 	/*
 	 * Walk the device list looking for the VLAN values associated with the access
 	 * device section of the device. Rules for these values will need to be applied
 	 * to the OVS switch
 	 */
-	need := make(map[string]bool)
+	owners := make(map[string]string)
 	devices, _ := netcfg.Path(DEVICES).ChildrenMap()
-	for _, device := range devices {
+	for id, device := range devices {
 		if device.Exists(ACCESS_DEVICE, VLAN) {
-			vlan := device.Search(ACCESS_DEVICE, VLAN).Data()
-
-			if val, ok := vlan.(string); ok {
-				need[val] = false
-			} else if _, ok := vlan.(float64); ok {
-				val := strconv.Itoa(int(vlan.(float64)))
-				need[val] = false
+			value := device.Search(ACCESS_DEVICE, VLAN).Data()
+			for _, vlan := range expandVlans(value, "device "+id) {
+				addSource(owners, vlan, SOURCE_NETCFG+id)
 			}
 		}
 	}
 
-	keys := make([]string, len(need))
-	for key, _ := range need {
-		keys = append(keys, key)
+	// Merge in the subscribers from SADIS, whether configured in the network
+	// configuration or served from a separate endpoint
+	if netcfg.Exists(APPS, SADIS_APP, SADIS, ENTRIES) {
+		entries, _ := netcfg.Search(APPS, SADIS_APP, SADIS, ENTRIES).Children()
+		sadisVlans(entries, owners)
+	}
+	if app.SadisUrl != "" {
+		app.sadisUrlVlans(owners)
 	}
-	log.Debugf("Need rules for VLANs %v", keys)
+	return owners
+}
 
-	// Fetch the current rules on the switch
-	resp, err = http.Get(fmt.Sprintf(FLOWS_URL, app.OnosConnectUrl, dpid))
-	if err != nil {
-		log.Warnf("Unable to read ONOS flows for swtich %s: %s", dpid, err)
-		return
+func (app *Application) Synchronize() error {
+	app.changes = nil
+	app.netcfg = nil
+	if !app.planning {
+		app.applySettings()
 	}
-	defer resp.Body.Close()
-	decoder = json.NewDecoder(resp.Body)
-	decoder.Decode(&raw)
-	outer, _ := gabs.Consume(raw)
-	flows, _ := outer.Path(FLOWS).Children()
 
 	/*
-	 * Iterate over all the flows, only paying attention to those that we created
-	 * If there is a flow for a VLAN ID that we know longer care about, i.e. it is
-	 * not needed, then delete it. If there is a flow for a VLAN we do care about
-	 * mark it as already installed.
+	 * Determine the switch and port to manage. If ONOS can't tell us, but we
+	 * have previously determined them, carry on with what we knew.
 	 */
-	for _, flow := range flows {
-		if flow.Exists(KEY_APP_ID) {
-			if APP_ID != flow.Path(KEY_APP_ID).Data().(string) {
-				continue
-			}
+	dpid, err := app.discoverSwitch()
+	if err != nil {
+		if app.snapshot == nil || app.snapshot.Switch == "" {
+			return err
+		}
+		log.Warnf("%s, using switch %s from snapshot taken %s", err, app.snapshot.Switch, app.snapshot.Timestamp)
+		dpid = app.snapshot.Switch
+	}
+	inPort, err := app.discoverPort(dpid)
+	if err != nil {
+		if app.snapshot == nil || app.snapshot.Switch != dpid || app.snapshot.Port == "" {
+			return err
+		}
+		log.Warnf("%s, using port %s from snapshot taken %s", err, app.snapshot.Port, app.snapshot.Timestamp)
+		inPort = app.snapshot.Port
+	}
 
-			criterias, _ := flow.Path("selector.criteria").Children()
-			for _, criteria := range criterias {
-				if criteria.Path("type").Data().(string) != "VLAN_VID" {
-					continue
-				}
-				vlan := strconv.Itoa(int(criteria.Path("vlanId").Data().(float64)))
-				if _, ok := need[vlan]; ok {
-					// Need this rule, mark as needed and found
-					need[vlan] = true
-				} else {
-					// Rule is not needed, delete it
-					log.Infof("[DELETE]: VLAN %s rule (%s)", vlan, flow.Path("id"))
-					if !app.Verify {
-						client := &http.Client{}
-						req, err := http.NewRequest(http.MethodDelete,
-							fmt.Sprintf(DELETE_FLOW_URL, app.OnosConnectUrl,
-								dpid, flow.Path("id").Data().(string)), nil)
-						if err != nil {
-							log.Errorf("Unable to create DELETE request for flow rule for VLAN %s  : %s", flow.Path("id"), vlan, err)
-							continue
-						}
-						resp, err := client.Do(req)
-						if err != nil {
-							log.Errorf("Unable to DELETE flow rule '%s' for VLAN %s : %s", flow.Path("id"), vlan, err)
-							continue
-						}
-						defer resp.Body.Close()
-						if int(resp.StatusCode/100) != 2 {
-							log.Errorf("Error response code while DELETEing flow fule '%s' for VLAN %s : %s", flow.Path("id"), vlan, resp.Status)
-							continue
-						}
-					}
-				}
-			}
+	// Let interested parties know when the switch or port being managed changes
+	if !app.planning && (dpid != app.switchDpid || inPort != app.switchPort) {
+		event := &Event{
+			Type:   EVENT_SWITCH_DISCOVERED,
+			Switch: dpid,
+			Port:   inPort,
+		}
+		if app.switchDpid != "" {
+			event.Type = EVENT_SWITCH_CHANGED
+			event.Message = fmt.Sprintf("previously switch %s port %s", app.switchDpid, app.switchPort)
 		}
+		app.notifier.Notify(event)
+		app.switchDpid = dpid
+		app.switchPort = inPort
 	}
 
-	// Iterate over all the required VLANs and if we don't have a rule for them
-	// then add them
-	rule := template.New(path.Base(app.CreateFlowTemplate))
-	_, err = rule.ParseFiles(app.CreateFlowTemplate)
+	/*
+	 * Fetch network config to get access to the list of access device VLAN IDs. If
+	 * the network configuration is unavailable continue to maintain the VLANs from
+	 * the last snapshot, so that flows that disappear from the switch are restored.
+	 */
+	owners, err := app.desiredState()
 	if err != nil {
-		log.Errorf("Unable to parse rule creation template '%s' : %s", app.CreateFlowTemplate, err)
-		return
+		if app.snapshot == nil {
+			return err
+		}
+		log.Warnf("%s, using %d VLANs from snapshot taken %s", err, len(app.snapshot.Vlans), app.snapshot.Timestamp)
+		owners = app.snapshot.Vlans
+		if !app.planning {
+			app.setStale(app.snapshot.Timestamp)
+		}
+	} else if !app.planning {
+		app.saveSnapshot(&Snapshot{
+			Switch: dpid,
+			Port:   inPort,
+			Vlans:  owners,
+		})
 	}
-	for vlan, have := range need {
-		if have {
-			log.Debugf("[EXISTS] VLAN %s rule", vlan)
-			continue
+	owners = app.applyStaticVlans(owners)
+	owners = app.applyOverrides(owners)
+	app.updateStatus(func(status *Status) {
+		status.Switch = dpid
+		status.Port = inPort
+		status.Vlans = len(owners)
+		status.Sources = owners
+	})
+	log.Debugf("Need rules for VLANs (and their sources) %v", owners)
+
+	// Determine the port on which each VLAN's traffic arrives
+	ports := make(map[string]string, len(owners))
+	if app.TopologyPorts {
+		ports = app.vlanPorts(dpid, inPort, owners)
+	} else {
+		for vlan := range owners {
+			ports[vlan] = inPort
 		}
-		log.Infof("[CREATE] VLAN %s rule", vlan)
-		data := RuleData{
-			AppId:  APP_ID,
-			DPID:   dpid,
-			VlanId: vlan,
-			InPort: inPort,
+	}
+
+	// When forwarding, determine the port out of which traffic is forwarded
+	outPort := ""
+	if app.Mode == MODE_FORWARD {
+		outPort, err = app.discoverOutputPort(dpid)
+		if err != nil {
+			return err
 		}
+	}
+
+	// Fetch the current rules on the switch, along with those of other
+	// applications when checking for conflicts
+	var flows, foreign []*gabs.Container
+	switch {
+	case app.ConflictCheck != CONFLICT_OFF:
+		flows, foreign, err = app.switchFlows(dpid)
+	case app.Programming != PROGRAM_INTENTS:
+		flows, err = app.managedFlows(dpid)
+	}
+	if err != nil {
+		return err
+	}
 
-		// Create a POST to ONOS
-		buf := bytes.NewBuffer(nil)
-		err := rule.Execute(buf, &data)
+	// Determine the meters that limit the traffic of each VLAN
+	var meters map[string]string
+	var owned map[string]bool
+	if app.MeterMode != "" {
+		meters, owned, err = app.assignMeters(dpid, owners, flows)
 		if err != nil {
-			log.Errorf("Unable to execute create rule template: %s", err)
+			return err
+		}
+	}
+
+	// Render the rules that should exist on the switch
+	desired, failed, err := app.desiredFlows(dpid, outPort, owners, ports, meters)
+	if err != nil {
+		return err
+	}
+	codec := app.codec()
+	need := make(map[string]*DesiredFlow)
+	for _, flow := range desired {
+		selector := flowSelector(codec, flow.Flow)
+		if other, ok := need[selector]; ok {
+			log.Warnf("The %s rule for VLAN %s matches the same traffic as the %s rule for VLAN %s, ignoring it",
+				flow.Direction, flow.Vlan, other.Direction, other.Vlan)
+			continue
 		}
-		if app.Verify {
-			var val map[string]interface{}
-			err = json.Unmarshal(buf.Bytes(), &val)
-			if err != nil {
-				log.Errorf("Unable to parse POST data : %s", err)
+		need[selector] = flow
+	}
+	if app.Programming != PROGRAM_INTENTS && !app.planning {
+		app.collectStats(flows, owners, need)
+	}
+
+	// Compare with what is programmed in ONOS
+	var changes []*FlowChange
+	var invalid int
+	switch app.Programming {
+	case PROGRAM_INTENTS:
+		changes, invalid, err = app.intentChanges(dpid, desired, need)
+	case PROGRAM_OBJECTIVES:
+		changes = app.objectiveChanges(dpid, owners, desired, need)
+	default:
+		changes, err = app.flowChanges(dpid, owners, flows, desired, need)
+	}
+	if err != nil {
+		return err
+	}
+	failed += invalid
+	app.changes = changes
+
+	if app.observing() {
+		for _, change := range changes {
+			if change.Action != AUDIT_CREATE {
 				continue
 			}
-			data, err := json.MarshalIndent(&val, "DATA: ", "    ")
-			if err != nil {
+			data := bytes.NewBuffer(nil)
+			if err := json.Indent(data, change.Flow, "DATA: ", "    "); err != nil {
 				log.Errorf("Unable to pretty print POST data : %s", err)
 				continue
 			}
 
-			log.Infof("\nDATA: %s", string(data))
-		} else {
-			resp, err := http.Post(fmt.Sprintf(FLOWS_URL, app.OnosConnectUrl, dpid), "application/json", buf)
-			if err != nil {
-				log.Errorf("Error while POSTing rule for VLAN %s to ONOS : %s", vlan, err)
+			log.Infof("\nDATA: %s", data.String())
+		}
+	}
+
+	// Make the changes, unless we are only verifying or planning what they would be
+	if !app.observing() {
+		failed += app.applyChanges(changes)
+		if app.Programming == PROGRAM_OBJECTIVES {
+			app.recordObjectives(changes)
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("Unable to apply %d flow rule changes to switch %s", failed, dpid)
+	}
+
+	// Now no rule references them, remove meters that are no longer needed
+	if app.MeterMode != "" {
+		app.removeMeters(dpid, meters, owned)
+	}
+
+	// Check that the rules are not made useless by those of other applications
+	if app.ConflictCheck != CONFLICT_OFF && !app.planning {
+		count := app.checkConflicts(desired, foreign)
+		if count > 0 && app.ConflictCheck == CONFLICT_FAIL {
+			return fmt.Errorf("Rules on switch %s have %d conflicts with flows of other applications", dpid, count)
+		}
+	}
+	return nil
+}
+
+/*
+ * flowChanges determines the changes needed to bring the flows created by
+ * letmein in line with the desired rules.
+ */
+func (app *Application) flowChanges(dpid string, owners map[string]string, flows []*gabs.Container, desired []*DesiredFlow, need map[string]*DesiredFlow) ([]*FlowChange, error) {
+	have := make(map[string]bool)
+	replace := make(map[string]string)
+
+	/*
+	 * Iterate over all the flows, only paying attention to those that we created.
+	 * If there is a flow that matches traffic we no longer care about, i.e. it is
+	 * not needed, then delete it. If there is a flow that matches the traffic of a
+	 * rule we need then it is already installed, unless what it does with the
+	 * traffic has changed, in which case it is replaced.
+	 */
+	codec := app.codec()
+	changes := []*FlowChange{}
+	keep := app.keepFlows(flows, need)
+	for _, flow := range flows {
+		if appId, _ := flow.Path(KEY_APP_ID).Data().(string); appId != APP_ID {
+			continue
+		}
+
+		vlan, port := codec.FlowMatch(flow)
+		selector := flowSelector(codec, flow)
+		want, ok := need[selector]
+		if kept, found := keep[selector]; found {
+			if kept == flow {
+				// Need this rule, mark as found
+				have[selector] = true
 				continue
 			}
-			defer resp.Body.Close()
-			if int(resp.StatusCode/100) != 2 {
-				log.Errorf("Error response code while POSTing flow rule for VLAN %s to ONOS : %s", vlan, resp.Status)
+			reason := fmt.Sprintf("duplicate of %s rule (%s) for VLAN %s", want.Direction, kept.Path("id").Data(), want.Vlan)
+			log.Infof("[DUPLICATE]: VLAN %s rule (%s) in table %s : %s", vlan, flow.Path("id"), flowTable(flow), reason)
+			changes = append(changes, &FlowChange{
+				Action: AUDIT_DELETE,
+				Switch: dpid,
+				Port:   port,
+				Vlan:   vlan,
+				FlowId: codec.FlowId(flow),
+				Flow:   flow.Bytes(),
+				Reason: reason,
+				Repair: true,
+			})
+			continue
+		}
+
+		reason := "VLAN no longer required by network configuration"
+		if ok {
+			/*
+			 * The rule has changed. ONOS identifies a flow by its selector and
+			 * priority, so if only the treatment has changed creating the new
+			 * rule replaces the existing one. Otherwise the existing rule is
+			 * deleted as well.
+			 */
+			reason = fmt.Sprintf("%s rule for VLAN %s changed", want.Direction, want.Vlan)
+			if canonical(flow.Path("priority").Data()) == canonical(want.Flow.Path("priority").Data()) {
+				log.Infof("[REPLACE]: VLAN %s rule (%s) in table %s : %s", vlan, flow.Path("id"), flowTable(flow), reason)
+				replace[selector] = reason
 				continue
 			}
+		} else if _, required := owners[vlan]; required {
+			reason = fmt.Sprintf("rule for VLAN %s no longer matches required traffic", vlan)
+		} else if override, excluded := app.excluded[vlan]; excluded {
+			reason = "override: " + override
+		}
+		log.Infof("[DELETE]: VLAN %s rule (%s) in table %s : %s", vlan, flow.Path("id"), flowTable(flow), reason)
+		changes = append(changes, &FlowChange{
+			Action: AUDIT_DELETE,
+			Switch: dpid,
+			Port:   port,
+			Vlan:   vlan,
+			FlowId: codec.FlowId(flow),
+			Flow:   flow.Bytes(),
+			Reason: reason,
+		})
+	}
+
+	// Iterate over all the required rules and if we don't have them then add them
+	for _, flow := range desired {
+		selector := flowSelector(codec, flow.Flow)
+		if need[selector] != flow {
+			continue
+		}
+		if have[selector] {
+			log.Debugf("[EXISTS] VLAN %s %s rule", flow.Vlan, flow.Direction)
+			continue
+		}
+		reason, ok := replace[selector]
+		if !ok {
+			reason = "VLAN required by network configuration"
+		}
+		log.Infof("[CREATE] VLAN %s %s rule in table %s", flow.Vlan, flow.Direction, flowTable(flow.Flow))
+		changes = append(changes, &FlowChange{
+			Action: AUDIT_CREATE,
+			Switch: dpid,
+			Port:   flow.Port,
+			Vlan:   flow.Vlan,
+			Flow:   flow.Body,
+			Reason: reason,
+			Source: flow.Source,
+		})
+	}
+	return changes, nil
+}
+
+/*
+ * keepFlows chooses, for each required rule, the managed flow that is kept as
+ * that rule when there are several, e.g. after a crash between changes or when
+ * two instances of letmein have run. The flow kept must match the rule and is
+ * preferably one that ONOS reports as ADDED. Any others are duplicates.
+ */
+func (app *Application) keepFlows(flows []*gabs.Container, need map[string]*DesiredFlow) map[string]*gabs.Container {
+	codec := app.codec()
+	keep := make(map[string]*gabs.Container)
+	for _, flow := range flows {
+		selector := flowSelector(codec, flow)
+		want, ok := need[selector]
+		if !ok || flowTreatment(codec, flow) != flowTreatment(codec, want.Flow) {
+			continue
+		}
+		if kept, found := keep[selector]; !found || (flowState(kept) != FLOW_ADDED && flowState(flow) == FLOW_ADDED) {
+			keep[selector] = flow
 		}
 	}
+	return keep
 }
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testSwitch = "of:0000000000000001"
+)
+
+/*
+ * testOnos is an ONOS that serves the recorded devices and ports of a switch,
+ * a network configuration and the flows on the switch. Flows are returned as
+ * ONOS returns them, which for 2.x is with their ports qualified by the port's
+ * name, and, as ONOS identifies a flow by its application, selector, priority
+ * and table, a flow added with the same selector as another replaces it and
+ * keeps its ID.
+ */
+type testOnos struct {
+	sync.Mutex
+	version    string
+	netcfg     string
+	noLocation bool
+	state      string
+	flows      map[string]map[string]interface{}
+	next       int
+	requests   []string
+}
+
+func newTestOnos(t *testing.T, version, flows, netcfg string) *testOnos {
+	onos := &testOnos{
+		version: version,
+		netcfg:  netcfg,
+		state:   FLOW_ADDED,
+		flows:   make(map[string]map[string]interface{}),
+	}
+	if flows != "" {
+		for _, child := range children(t, flows, "flows") {
+			flow := child.Data().(map[string]interface{})
+			onos.flows[jsonString(flow["id"])] = flow
+		}
+	}
+	return onos
+}
+
+// legacy returns true if the ONOS is 1.x, which does not report its version
+func (onos *testOnos) legacy() bool {
+	return onos.version == ""
+}
+
+// port returns a port number as ONOS returns it in a flow
+func (onos *testOnos) port(value interface{}) interface{} {
+	number := jsonString(value)
+	if _, err := fmt.Sscanf(number, "%d", new(int)); err != nil {
+		return value
+	}
+	if onos.legacy() {
+		var port float64
+		fmt.Sscanf(number, "%g", &port)
+		return port
+	}
+	return fmt.Sprintf("[eth%s](%s)", number, number)
+}
+
+// add adds a flow as ONOS would, returning its ID
+func (onos *testOnos) add(flow map[string]interface{}) string {
+	criteria, _ := flow["selector"].(map[string]interface{})["criteria"].([]interface{})
+	for _, item := range criteria {
+		criterion := item.(map[string]interface{})
+		if port, ok := criterion["port"]; ok {
+			criterion["port"] = onos.port(port)
+		}
+		if vlan, ok := criterion["vlanId"]; ok && onos.legacy() {
+			var number float64
+			fmt.Sscanf(jsonString(vlan), "%g", &number)
+			criterion["vlanId"] = number
+		}
+	}
+	instructions, _ := flow["treatment"].(map[string]interface{})["instructions"].([]interface{})
+	for _, item := range instructions {
+		instruction := item.(map[string]interface{})
+		if port, ok := instruction["port"]; ok {
+			instruction["port"] = onos.port(port)
+		}
+	}
+	flow["tableId"] = jsonString(flow["tableId"])
+	flow["state"] = onos.state
+	flow["packets"] = 0.0
+	flow["bytes"] = 0.0
+
+	key := func(flow map[string]interface{}) string {
+		return fmt.Sprintf("%v/%s/%s/%s", flow[KEY_APP_ID], canonical(flow["selector"]),
+			canonical(flow["priority"]), canonical(flow["tableId"]))
+	}
+	for id, existing := range onos.flows {
+		if key(existing) == key(flow) {
+			flow["id"] = id
+			onos.flows[id] = flow
+			return id
+		}
+	}
+	onos.next++
+	id := fmt.Sprintf("%d", 281475339452000+onos.next)
+	flow["id"] = id
+	onos.flows[id] = flow
+	return id
+}
+
+// list returns the flows, of letmein only if managed, ordered by ID
+func (onos *testOnos) list(managed bool) map[string]interface{} {
+	ids := []string{}
+	for id := range onos.flows {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	flows := []interface{}{}
+	for _, id := range ids {
+		if !managed || onos.flows[id][KEY_APP_ID] == APP_ID {
+			flows = append(flows, onos.flows[id])
+		}
+	}
+	return map[string]interface{}{"flows": flows}
+}
+
+// managed returns the number of letmein's flows
+func (onos *testOnos) managed() int {
+	onos.Lock()
+	defer onos.Unlock()
+	return len(onos.list(true)["flows"].([]interface{}))
+}
+
+func (onos *testOnos) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	onos.Lock()
+	defer onos.Unlock()
+	onos.requests = append(onos.requests, r.Method+" "+r.URL.Path)
+
+	flowsUrl := "/onos/v1/flows/" + testSwitch
+	devices, ports := currentDevices, currentPorts
+	if onos.legacy() {
+		devices, ports = legacyDevices, legacyPorts
+	}
+	switch path := r.URL.Path; {
+	case path == "/onos/v1/system" && !onos.legacy():
+		fmt.Fprintf(w, `{"version":"%s"}`, onos.version)
+	case path == "/onos/v1/devices":
+		w.Write([]byte(devices))
+	case path == "/onos/v1/devices/"+testSwitch+"/ports":
+		w.Write([]byte(ports))
+	case path == "/onos/v1/network/configuration":
+		w.Write([]byte(onos.netcfg))
+	case path == "/onos/v1/flows/application/"+APP_ID:
+		json.NewEncoder(w).Encode(onos.list(true))
+	case path == flowsUrl && r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(onos.list(false))
+	case path == flowsUrl && r.Method == http.MethodPost:
+		var flow map[string]interface{}
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &flow); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id := onos.add(flow)
+		if !onos.noLocation {
+			w.Header().Set("Location", flowsUrl+"/"+id)
+		}
+		w.WriteHeader(http.StatusCreated)
+	case strings.HasPrefix(path, flowsUrl+"/"):
+		id := strings.TrimPrefix(path, flowsUrl+"/")
+		flow, ok := onos.flows[id]
+		switch {
+		case !ok:
+			http.NotFound(w, r)
+		case r.Method == http.MethodDelete:
+			delete(onos.flows, id)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"flows": []interface{}{flow}})
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// testApplication returns an application that punts the traffic arriving on
+// port 1 of the switch, configured as by the defaults
+func testApplication(t *testing.T, url string) *Application {
+	app := newApplication()
+	app.OnosConnectUrl = url
+	app.OnosVersion = VERSION_DETECT
+	app.OvsDpid = DISCOVER
+	app.OvsPort = "1"
+	app.CreateFlowTemplate = "rule.tmpl"
+	app.Mode = MODE_PUNT
+	app.Programming = PROGRAM_FLOWS
+	app.ConflictCheck = CONFLICT_OFF
+	app.DesiredSources = []string{"netcfg"}
+	app.DesiredCompose = COMPOSE_UNION
+	app.Workers = 2
+	app.MakeBeforeBreak = true
+	app.ReplaceTimeout = time.Second
+	if err := app.configure(); err != nil {
+		t.Fatalf("Unable to configure application : %s", err)
+	}
+	return app
+}
+
+// planned describes the changes of the last synchronization, e.g.
+// "delete:100,create:100"
+func planned(app *Application) string {
+	changes := []string{}
+	for _, change := range app.changes {
+		changes = append(changes, change.Action+":"+change.Vlan)
+	}
+	return strings.Join(changes, ",")
+}
+
+func netcfgVlan(vlan string) string {
+	return fmt.Sprintf(`{"devices":{"of:0000000000000aaa":{"accessDevice":{"vlan":"%s"}}}}`, vlan)
+}
+
+// TestSynchronize checks that the rules are installed once, by running
+// synchronizations until no changes are planned
+func TestSynchronize(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		version string
+		flows   string
+		port    string
+		vlans   string
+		cycles  []string
+		managed int
+	}{
+		{"2.x rule installed", "2.7.0", currentFlows, "1", "200", []string{"", ""}, 1},
+		{"2.x VLAN added", "2.7.0", currentFlows, "1", "200,300", []string{"create:300", ""}, 2},
+		{"2.x VLAN removed", "2.7.0", currentFlows, "1", "300", []string{"delete:200,create:300", ""}, 1},
+		{"2.x port changed", "2.7.0", currentFlows, "2", "200", []string{"delete:200,create:200", ""}, 1},
+		{"2.x no rules", "2.7.0", "", "1", "100-101", []string{"create:100,create:101", "", ""}, 2},
+		{"1.x no rules", "", "", "1", "100-101", []string{"create:100,create:101", "", ""}, 2},
+	} {
+		onos := newTestOnos(t, test.version, test.flows, netcfgVlan(test.vlans))
+		server := httptest.NewServer(onos)
+		app := testApplication(t, server.URL)
+		app.OvsPort = test.port
+		for cycle, expected := range test.cycles {
+			if err := app.Synchronize(); err != nil {
+				t.Errorf("%s: cycle %d failed : %s", test.name, cycle+1, err)
+			}
+			if changes := planned(app); changes != expected {
+				t.Errorf("%s: cycle %d planned '%s', expected '%s'", test.name, cycle+1, changes, expected)
+			}
+		}
+		if managed := onos.managed(); managed != test.managed {
+			t.Errorf("%s: %d rules on the switch, expected %d", test.name, managed, test.managed)
+		}
+		server.Close()
+	}
+}
+
+// TestDuplicates checks that, of several rules that match the traffic of a
+// VLAN, the one that matches the template and ONOS reports as added is kept
+func TestDuplicates(t *testing.T) {
+	type testFlow struct {
+		id       string
+		priority float64
+		state    string
+	}
+	for _, test := range []struct {
+		name    string
+		flows   []testFlow
+		cycles  []string
+		kept    []string
+		managed int
+	}{
+		{"other priority", []testFlow{{"281475339451457", 32768, FLOW_ADDED}, {"281475339451400", 40000, FLOW_ADDED}},
+			[]string{"delete:200", ""}, []string{"281475339451457"}, 1},
+		{"pending duplicate", []testFlow{{"281475339451457", 32768, FLOW_ADDED}, {"281475339451400", 32768, "PENDING_ADD"}},
+			[]string{"delete:200", ""}, []string{"281475339451457"}, 1},
+		{"added duplicate", []testFlow{{"281475339451457", 32768, "PENDING_ADD"}, {"281475339451400", 32768, FLOW_ADDED}},
+			[]string{"delete:200", ""}, []string{"281475339451400"}, 1},
+		{"first of several kept", []testFlow{{"281475339451457", 32768, FLOW_ADDED}, {"281475339451400", 32768, FLOW_ADDED},
+			{"281475339451401", 32768, FLOW_ADDED}}, []string{"delete:200,delete:200", ""}, []string{"281475339451400"}, 1},
+		{"none match template", []testFlow{{"281475339451457", 100, FLOW_ADDED}, {"281475339451400", 200, FLOW_ADDED}},
+			[]string{"delete:200,delete:200,create:200", ""}, []string{}, 1},
+	} {
+		onos := newTestOnos(t, "2.7.0", currentFlows, netcfgVlan("200"))
+		original := onos.flows["281475339451457"]
+		for _, flow := range test.flows {
+			var duplicate map[string]interface{}
+			data, _ := json.Marshal(original)
+			json.Unmarshal(data, &duplicate)
+			duplicate["id"] = flow.id
+			duplicate["priority"] = flow.priority
+			duplicate["state"] = flow.state
+			onos.flows[flow.id] = duplicate
+		}
+		server := httptest.NewServer(onos)
+		app := testApplication(t, server.URL)
+		for cycle, expected := range test.cycles {
+			if err := app.Synchronize(); err != nil {
+				t.Errorf("%s: cycle %d failed : %s", test.name, cycle+1, err)
+			}
+			if changes := planned(app); changes != expected {
+				t.Errorf("%s: cycle %d planned '%s', expected '%s'", test.name, cycle+1, changes, expected)
+			}
+		}
+		server.Close()
+
+		kept := []string{}
+		for _, flow := range test.flows {
+			if _, ok := onos.flows[flow.id]; ok {
+				kept = append(kept, flow.id)
+			}
+		}
+		if strings.Join(kept, ",") != strings.Join(test.kept, ",") {
+			t.Errorf("%s: kept rules %v, expected %v", test.name, kept, test.kept)
+		}
+		if managed := onos.managed(); managed != test.managed {
+			t.Errorf("%s: %d rules on the switch, expected %d", test.name, managed, test.managed)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/Jeffail/gabs"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	CONFIRM_INTERVAL = 250 * time.Millisecond
+)
+
+// FlowChange is a single flow rule to create or delete on a switch, along
+// with the outcome of making the change
+type FlowChange struct {
+	Action string
+	Switch string
+	Port   string
+	Vlan   string
+	FlowId string
+	Flow   []byte
+	Reason string
+	Source string
+	Repair bool
+	Err    error
+
+	// Selector identifies the rule of an objective, Applied that the change
+	// was made
+	Selector string
+	Applied  bool
+}
+
+// FlowWorker applies flow changes to ONOS. A pool of workers is used so that
+// changes are made concurrently, without overwhelming ONOS.
+type FlowWorker struct {
+	id     int
+	app    *Application
+	client *http.Client
+}
+
+// run applies changes until there are no more
+func (worker *FlowWorker) run(changes <-chan *FlowChange, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for change := range changes {
+		change.Err = worker.apply(change)
+		if change.Err != nil {
+			log.Error(change.Err)
+			metrics.Inc("letmein_flow_change_errors_total")
+			continue
+		}
+		change.Applied = true
+	}
+}
+
+// apply makes a single change, the response from ONOS is always consumed
+// and closed before returning so that connections can be reused
+func (worker *FlowWorker) apply(change *FlowChange) error {
+	app := worker.app
+	log.Debugf("Worker %d %s VLAN %s rule", worker.id, change.Action, change.Vlan)
+
+	req, err := app.changeRequest(change)
+	if err != nil {
+		return fmt.Errorf("Unable to create %s request for flow rule for VLAN %s : %s", change.Action, change.Vlan, err)
+	}
+
+	resp, err := worker.client.Do(req)
+	if err == nil {
+		defer resp.Body.Close()
+		if change.Action == AUDIT_CREATE && change.FlowId == "" && resp.Header.Get("Location") != "" {
+			change.FlowId = path.Base(resp.Header.Get("Location"))
+		}
+	}
+	response := auditResponse(resp, err)
+	if app.audit != nil {
+		app.audit.Record(&AuditRecord{
+			Switch:   change.Switch,
+			Vlan:     change.Vlan,
+			FlowId:   change.FlowId,
+			Action:   change.Action,
+			Flow:     json.RawMessage(change.Flow),
+			Reason:   change.Reason,
+			Device:   change.Source,
+			Response: response,
+		})
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to %s flow rule '%s' for VLAN %s : %s", change.Action, change.FlowId, change.Vlan, err)
+	}
+	if int(resp.StatusCode/100) != 2 {
+		return fmt.Errorf("Error response code while %s flow rule '%s' for VLAN %s : %s",
+			change.Action, change.FlowId, change.Vlan, resp.Status)
+	}
+
+	event := &Event{
+		Switch: change.Switch,
+		Port:   change.Port,
+		Vlan:   change.Vlan,
+		FlowId: change.FlowId,
+	}
+	if change.Action == AUDIT_CREATE {
+		metrics.Inc("letmein_flows_created_total")
+		event.Type = EVENT_FLOW_CREATED
+	} else {
+		metrics.Inc("letmein_flows_deleted_total")
+		if change.Repair {
+			metrics.Inc("letmein_duplicate_flows_removed_total")
+		}
+		event.Type = EVENT_FLOW_DELETED
+	}
+	app.notifier.Notify(event)
+	return nil
+}
+
+// runChanges dispatches the changes to a pool of workers, waits for them to
+// be made and returns the number that failed. The error for each failed
+// change is recorded in the change.
+func (app *Application) runChanges(changes []*FlowChange) int {
+	if len(changes) == 0 {
+		return 0
+	}
+	count := app.Workers
+	if count < 1 {
+		count = 1
+	}
+	if count > len(changes) {
+		count = len(changes)
+	}
+
+	queue := make(chan *FlowChange)
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		worker := &FlowWorker{
+			id:     i,
+			app:    app,
+			client: app.client,
+		}
+		go worker.run(queue, &wg)
+	}
+	for _, change := range changes {
+		queue <- change
+	}
+	close(queue)
+	wg.Wait()
+
+	failed := 0
+	for _, change := range changes {
+		if change.Err != nil {
+			failed++
+		}
+	}
+	return failed
+}
+
+/*
+ * applyChanges makes the changes and returns the number that failed. So that
+ * a VLAN's traffic is not dropped while its rules are replaced, unless make
+ * before break is disabled the rules that replace those of a VLAN are created
+ * first and only once ONOS confirms they are installed are the rules they
+ * replace deleted. Should a replacement not be confirmed within the timeout it
+ * is rolled back, leaving the VLAN's existing rules in place.
+ */
+func (app *Application) applyChanges(changes []*FlowChange) int {
+	if !app.MakeBeforeBreak {
+		return app.runChanges(changes)
+	}
+
+	replaced := make(map[string]bool)
+	for _, change := range changes {
+		if change.Action == AUDIT_CREATE {
+			replaced[change.Vlan] = true
+		}
+	}
+	first, deferred := []*FlowChange{}, []*FlowChange{}
+	for _, change := range changes {
+		if change.Action == AUDIT_DELETE && replaced[change.Vlan] {
+			deferred = append(deferred, change)
+		} else {
+			first = append(first, change)
+		}
+	}
+	failed := app.runChanges(first)
+	if len(deferred) == 0 {
+		return failed
+	}
+
+	// Confirm the replacement rules are installed, rolling back any that are not
+	confirmed := make(map[string]bool)
+	installed := make(map[string]bool)
+	rollback := []*FlowChange{}
+	deadline := time.Now().Add(app.ReplaceTimeout)
+	for _, change := range first {
+		if change.Action != AUDIT_CREATE {
+			continue
+		}
+		if _, ok := confirmed[change.Vlan]; !ok {
+			confirmed[change.Vlan] = true
+		}
+		if change.Err != nil {
+			confirmed[change.Vlan] = false
+			continue
+		}
+		if err := app.confirmChange(change, deadline); err != nil {
+			metrics.Inc("letmein_flow_change_errors_total")
+			failed++
+			confirmed[change.Vlan] = false
+			if change.FlowId == "" {
+				// Without its ID the replacement cannot be rolled back
+				log.Errorf("Unable to confirm replacement rule for VLAN %s : %s", change.Vlan, err)
+				continue
+			}
+			log.Errorf("Unable to confirm replacement rule for VLAN %s : %s, rolling back", change.Vlan, err)
+			rollback = append(rollback, &FlowChange{
+				Action: AUDIT_DELETE,
+				Switch: change.Switch,
+				Port:   change.Port,
+				Vlan:   change.Vlan,
+				FlowId: change.FlowId,
+				Flow:   change.Flow,
+				Reason: fmt.Sprintf("rollback of replacement rule for VLAN %s : %s", change.Vlan, err),
+				Source: change.Source,
+			})
+			continue
+		}
+		if change.FlowId != "" {
+			installed[change.FlowId] = true
+		}
+	}
+
+	/*
+	 * Now its replacements are in place, remove each VLAN's previous rules.
+	 * ONOS derives the ID of a flow from its application, switch, selector,
+	 * priority and table, so a replacement may have been installed in place
+	 * of the rule it replaces, with its ID, and that rule is already gone.
+	 */
+	remove := []*FlowChange{}
+	for _, change := range deferred {
+		if !confirmed[change.Vlan] {
+			log.Warnf("[KEEP]: VLAN %s rule (%s) : its replacement is not installed", change.Vlan, change.FlowId)
+			continue
+		}
+		if installed[change.FlowId] {
+			log.Infof("[REPLACED]: VLAN %s rule (%s) : its replacement was installed in its place", change.Vlan, change.FlowId)
+			continue
+		}
+		remove = append(remove, change)
+	}
+	for _, change := range rollback {
+		log.Infof("[DELETE]: VLAN %s rule (%s) : %s", change.Vlan, change.FlowId, change.Reason)
+	}
+	return failed + app.runChanges(append(rollback, remove...))
+}
+
+/*
+ * confirmChange waits, until the deadline, for ONOS to report that the rule
+ * created by a change is installed on the switch. The flows programmed for
+ * flow objectives cannot be identified, so objectives are taken to be
+ * installed once ONOS accepts them. A flow whose ID ONOS did not return when
+ * it was created is looked up by its selector and treatment.
+ */
+func (app *Application) confirmChange(change *FlowChange, deadline time.Time) error {
+	var url, installed string
+	switch app.Programming {
+	case PROGRAM_OBJECTIVES:
+		return nil
+	case PROGRAM_INTENTS:
+		url = fmt.Sprintf(DELETE_INTENT_URL, app.OnosConnectUrl, APP_ID, change.FlowId)
+		installed = INTENT_INSTALLED
+	default:
+		url = fmt.Sprintf(DELETE_FLOW_URL, app.OnosConnectUrl, change.Switch, change.FlowId)
+		installed = FLOW_ADDED
+	}
+
+	state := "unknown"
+	for {
+		if change.FlowId == "" {
+			if err := app.findCreatedFlow(change); err != nil {
+				log.Debugf("Unable to find replacement rule for VLAN %s : %s", change.Vlan, err)
+			} else if change.FlowId != "" {
+				url = fmt.Sprintf(DELETE_FLOW_URL, app.OnosConnectUrl, change.Switch, change.FlowId)
+			}
+		}
+		if change.FlowId != "" {
+			wrapper, err := app.fetchJSON(url)
+			if err == nil {
+				if wrapper.Exists(FLOWS) {
+					wrapper = wrapper.Path(FLOWS).Index(0)
+				}
+				state, _ = wrapper.Path("state").Data().(string)
+				if state == installed {
+					return nil
+				}
+				if state == FLOW_FAILED || state == INTENT_FAILED || state == INTENT_WITHDRAWN {
+					return fmt.Errorf("rule (%s) is %s", change.FlowId, state)
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			if change.FlowId == "" {
+				return fmt.Errorf("rule not found after %s", app.ReplaceTimeout)
+			}
+			return fmt.Errorf("rule (%s) not installed after %s, state %s", change.FlowId, app.ReplaceTimeout, state)
+		}
+		time.Sleep(CONFIRM_INTERVAL)
+	}
+}
+
+// findCreatedFlow sets the ID of the flow created by a change, if a managed
+// flow with the same selector and treatment is on the switch
+func (app *Application) findCreatedFlow(change *FlowChange) error {
+	rule, err := gabs.ParseJSON(change.Flow)
+	if err != nil {
+		return err
+	}
+	flows, err := app.managedFlows(change.Switch)
+	if err != nil {
+		return err
+	}
+	codec := app.codec()
+	for _, flow := range flows {
+		if flowSelector(codec, flow) == flowSelector(codec, rule) && flowTreatment(codec, flow) == flowTreatment(codec, rule) {
+			change.FlowId = codec.FlowId(flow)
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRule renders the punt rule for a VLAN arriving on a port of the switch
+func testRule(t *testing.T, port, vlan string) []byte {
+	rule, err := loadTemplate("rule.tmpl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _, err := renderFlow(rule, &RuleData{
+		AppId:   APP_ID,
+		DPID:    testSwitch,
+		VlanId:  vlan,
+		InPort:  port,
+		TableId: "0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// writes describes the changes made to ONOS, in the order they were made,
+// e.g. "POST,DELETE"
+func (onos *testOnos) writes() string {
+	onos.Lock()
+	defer onos.Unlock()
+	methods := []string{}
+	for _, request := range onos.requests {
+		if method := strings.SplitN(request, " ", 2)[0]; method != "GET" {
+			methods = append(methods, method)
+		}
+	}
+	return strings.Join(methods, ",")
+}
+
+// TestApplyChanges checks that a VLAN's rule is only deleted once the rule
+// that replaces it is installed, and is not deleted when ONOS installed its
+// replacement in its place
+func TestApplyChanges(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		port       string
+		noLocation bool
+		state      string
+		failed     int
+		writes     string
+		kept       bool
+		managed    int
+	}{
+		{"replaced by rule for another port", "2", false, FLOW_ADDED, 0, "POST,DELETE", false, 1},
+		{"replaced in place", "1", false, FLOW_ADDED, 0, "POST", true, 1},
+		{"replaced without location", "2", true, FLOW_ADDED, 0, "POST,DELETE", false, 1},
+		{"replaced in place without location", "1", true, FLOW_ADDED, 0, "POST", true, 1},
+		{"replacement not installed", "2", false, "PENDING_ADD", 1, "POST,DELETE", true, 1},
+		{"replacement not installed without location", "2", true, "PENDING_ADD", 1, "POST,DELETE", true, 1},
+	} {
+		onos := newTestOnos(t, "2.7.0", "", "")
+		var old map[string]interface{}
+		json.Unmarshal(testRule(t, "1", "200"), &old)
+		id := onos.add(old)
+		onos.noLocation = test.noLocation
+		onos.state = test.state
+
+		server := httptest.NewServer(onos)
+		app := testApplication(t, server.URL)
+		app.ReplaceTimeout = 3 * CONFIRM_INTERVAL
+		start := time.Now()
+		failed := app.applyChanges([]*FlowChange{
+			{Action: AUDIT_DELETE, Switch: testSwitch, Port: "1", Vlan: "200", FlowId: id},
+			{Action: AUDIT_CREATE, Switch: testSwitch, Port: test.port, Vlan: "200", Flow: testRule(t, test.port, "200")},
+		})
+		server.Close()
+
+		if failed != test.failed {
+			t.Errorf("%s: %d changes failed, expected %d", test.name, failed, test.failed)
+		}
+		if test.failed == 0 && time.Since(start) >= app.ReplaceTimeout {
+			t.Errorf("%s: replacement was not confirmed", test.name)
+		}
+		if writes := onos.writes(); writes != test.writes {
+			t.Errorf("%s: made changes %s, expected %s", test.name, writes, test.writes)
+		}
+		if _, kept := onos.flows[id]; kept != test.kept {
+			t.Errorf("%s: rule (%s) kept %t, expected %t", test.name, id, kept, test.kept)
+		}
+		if managed := onos.managed(); managed != test.managed {
+			t.Errorf("%s: %d rules on the switch, expected %d", test.name, managed, test.managed)
+		}
+	}
+}